@@ -0,0 +1,235 @@
+package gofactor
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"reflect"
+
+	"github.com/bblfsh/sdk/v3/uast/nodes"
+	"github.com/bblfsh/sdk/v3/uast/transformer"
+	"github.com/lwsanty/gofactor/golang"
+)
+
+var (
+	identType    = reflect.TypeOf((*ast.Ident)(nil))
+	stmtType     = reflect.TypeOf((*ast.Stmt)(nil)).Elem()
+	stmtListType = reflect.TypeOf([]ast.Stmt(nil))
+)
+
+// stmtLists returns all statement lists of the tree in depth-first order, so nested lists are always found after
+// the parent one
+func stmtLists(root ast.Node) []*[]ast.Stmt {
+	var lists []*[]ast.Stmt
+	ast.Inspect(root, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.BlockStmt:
+			lists = append(lists, &n.List)
+		case *ast.CaseClause:
+			lists = append(lists, &n.Body)
+		case *ast.CommClause:
+			lists = append(lists, &n.Body)
+		}
+		return true
+	})
+	return lists
+}
+
+// wrapDecls wraps top-level declarations into declaration statements, so rules match them as statements
+func wrapDecls(decls []ast.Decl) []ast.Stmt {
+	stmts := make([]ast.Stmt, 0, len(decls))
+	for _, decl := range decls {
+		stmts = append(stmts, &ast.DeclStmt{Decl: decl})
+	}
+	return stmts
+}
+
+// unwrapDecls returns declarations wrapped by wrapDecls
+func unwrapDecls(stmts []ast.Stmt) ([]ast.Decl, error) {
+	decls := make([]ast.Decl, 0, len(stmts))
+	for _, stmt := range stmts {
+		ds, ok := stmt.(*ast.DeclStmt)
+		if !ok {
+			return nil, fmt.Errorf("unexpected top-level statement %T", stmt)
+		}
+		decls = append(decls, ds.Decl)
+	}
+	return decls, nil
+}
+
+// transformList replaces all non-overlapping leftmost matches of the rule in the statement list
+func (r *Refactor) transformList(list *[]ast.Stmt, fs *token.FileSet) (bool, error) {
+	stmts := *list
+	starts, states, err := r.match(stmts, fs, r.conf.maxMatches)
+	if err != nil || len(starts) == 0 {
+		return false, err
+	}
+
+	var (
+		res  []ast.Stmt
+		last int
+	)
+	for i, start := range starts {
+		repl, err := r.construct(states[i])
+		if err != nil {
+			return false, err
+		}
+		res = append(res, stmts[last:start]...)
+		res = append(res, repl...)
+		last = start + len(r.stmts)
+	}
+	*list = append(res, stmts[last:]...)
+	return true, nil
+}
+
+// match finds non-overlapping leftmost matches of the rule in the statement list and returns indexes of the first
+// matched statements together with matched states. If limit is positive, at most limit matches are returned.
+func (r *Refactor) match(stmts []ast.Stmt, fs *token.FileSet, limit int) ([]int, []*transformer.State, error) {
+	windowLen := len(r.stmts)
+
+	var (
+		starts []int
+		states []*transformer.State
+	)
+loop:
+	for i := 0; i+windowLen <= len(stmts); i++ {
+		window := stmts[i : i+windowLen]
+		for j, pattern := range r.stmts {
+			if !shapeMatch(reflect.ValueOf(pattern), reflect.ValueOf(window[j])) {
+				continue loop
+			}
+		}
+		st, ok, err := r.check(window, fs)
+		if err != nil {
+			return nil, nil, err
+		} else if !ok {
+			continue
+		}
+
+		starts = append(starts, i)
+		states = append(states, st)
+		if limit > 0 && len(starts) >= limit {
+			break
+		}
+		// continue right after the matched window, so matches do not overlap
+		i += windowLen - 1
+	}
+	return starts, states, nil
+}
+
+// check converts statements to UAST and checks them against the rule
+func (r *Refactor) check(window []ast.Stmt, fs *token.FileSet) (*transformer.State, bool, error) {
+	arr, err := golang.ValueToNode(reflect.ValueOf(window), fs)
+	if err != nil {
+		return nil, false, err
+	}
+	arr, err = trimPositions(arr)
+	if err != nil {
+		return nil, false, err
+	}
+
+	st := transformer.NewState()
+	if ok, err := r.inArr.Check(st, arr); err != nil || !ok {
+		return nil, false, err
+	}
+	return st, true, nil
+}
+
+// construct builds the replacement statements from the matched state
+func (r *Refactor) construct(st *transformer.State) ([]ast.Stmt, error) {
+	out, err := r.outArr.Construct(st, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	outArr, _ := out.(nodes.Array)
+	repl := make([]ast.Stmt, 0, len(outArr))
+	for _, n := range outArr {
+		stmt, ok := golang.NodeToAST(n).(ast.Stmt)
+		if !ok {
+			return nil, transformer.ErrUnexpectedType.New(stmtType, n)
+		}
+		repl = append(repl, stmt)
+	}
+	return repl, nil
+}
+
+// shapeMatch is a fast structural check of the node against the pattern without conversion to UAST.
+// It ignores positions and doesn't check metavariable constraints, but never fails if the node matches the pattern,
+// so the full check is only needed if it succeeds.
+func shapeMatch(pattern, node reflect.Value) bool {
+	if shapeAny(pattern) {
+		return true
+	}
+	if pattern.Type() == identType && node.Type() == identType && !pattern.IsNil() && !node.IsNil() {
+		// identifiers of the code may refer to objects in scope-aware mode
+		return pattern.Interface().(*ast.Ident).Name == baseName(node.Interface().(*ast.Ident).Name)
+	}
+	switch pattern.Kind() {
+	case reflect.Interface:
+		if pattern.IsNil() || node.IsNil() {
+			return pattern.IsNil() == node.IsNil()
+		}
+		return shapeMatch(pattern.Elem(), node.Elem())
+	case reflect.Ptr:
+		if pattern.Type() != node.Type() {
+			return false
+		} else if pattern.Type() == golang.ScopeType || pattern.Type() == golang.ObjectType {
+			// not converted to UAST
+			return true
+		} else if pattern.IsNil() || node.IsNil() {
+			return pattern.IsNil() == node.IsNil()
+		}
+		return shapeMatch(pattern.Elem(), node.Elem())
+	case reflect.Struct:
+		for i := 0; i < pattern.NumField(); i++ {
+			if pattern.Type().Field(i).Type == golang.PosType {
+				continue
+			}
+			if !shapeMatch(pattern.Field(i), node.Field(i)) {
+				return false
+			}
+		}
+		return true
+	case reflect.Slice:
+		// empty and nil slices are the same in UAST
+		if pattern.Len() != node.Len() {
+			return false
+		}
+		for i := 0; i < pattern.Len(); i++ {
+			if !shapeMatch(pattern.Index(i), node.Index(i)) {
+				return false
+			}
+		}
+		return true
+	default:
+		return pattern.Interface() == node.Interface()
+	}
+}
+
+// shapeAny reports whether the pattern may match nodes of any shape: metavariables, statement lists matched by
+// $repeat(X1) and repeated branches
+func shapeAny(pattern reflect.Value) bool {
+	switch pattern.Type() {
+	case identType:
+		return !pattern.IsNil() && isMetaVar(pattern.Interface().(*ast.Ident).Name)
+	case stmtType:
+		ifs, ok := pattern.Interface().(*ast.IfStmt)
+		return ok && isRepeatCall(ifs.Cond)
+	case stmtListType:
+		list := pattern.Interface().([]ast.Stmt)
+		if len(list) == 1 {
+			if stmt, ok := list[0].(*ast.ExprStmt); ok && isRepeatCall(stmt.X) {
+				if id, ok := stmt.X.(*ast.CallExpr).Args[0].(*ast.Ident); ok && isMetaVar(id.Name) {
+					return true
+				}
+			}
+		}
+		for _, stmt := range list {
+			if cc, ok := stmt.(*ast.CaseClause); ok && len(cc.List) == 1 && isRepeatCall(cc.List[0]) {
+				return true
+			}
+		}
+	}
+	return false
+}
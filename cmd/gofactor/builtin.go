@@ -0,0 +1,38 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/lwsanty/gofactor"
+)
+
+// builtinCmd runs 'gofactor builtin' subcommands, which are refactorings implemented in Go instead of rules
+func builtinCmd(args []string) error {
+	if len(args) < 2 || args[0] != "tailrec" {
+		return errors.New("usage: gofactor builtin tailrec <file>...")
+	}
+	for _, path := range args[1:] {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		out, changed, skips, err := gofactor.TailRec(string(data))
+		if err != nil {
+			return fmt.Errorf("failed to transform %q: %v", path, err)
+		}
+		for _, s := range skips {
+			s.Pos.Filename = path
+			fmt.Fprintln(os.Stderr, s)
+		}
+		if !changed {
+			continue
+		}
+		if err := writeFile(path, []byte(out)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
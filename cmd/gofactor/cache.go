@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/lwsanty/gofactor"
+)
+
+// cache remembers files that were not changed by the rules, so they can be skipped in the next runs.
+// Entries are keyed by file contents, rules, gofactor version and the binary, thus no explicit invalidation is needed.
+type cache struct {
+	dir   string
+	rules string
+	// version is the gofactor version, entries of other versions are never hit
+	version string
+	// build identifies the binary: development builds share the version, and custom operations compiled into the
+	// binary may change without changing the rules
+	build string
+}
+
+// defaultCacheDir returns a cache directory in user's cache location
+func defaultCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "gofactor")
+}
+
+func newCache(dir, rules string) (*cache, error) {
+	build, err := buildID()
+	if err != nil {
+		return nil, fmt.Errorf("cache: can't identify the binary: %v", err)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &cache{dir: dir, rules: rules, version: gofactor.Version, build: build}, nil
+}
+
+// buildID returns the hash of the running executable
+func buildID() (string, error) {
+	path, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (c *cache) path(data []byte) string {
+	h := sha256.New()
+	h.Write([]byte(c.version + "\n" + c.build + "\n" + c.rules + "\n"))
+	h.Write(data)
+	key := hex.EncodeToString(h.Sum(nil))
+	return filepath.Join(c.dir, key[:2], key)
+}
+
+// unchanged reports whether the rules are known to not change the file
+func (c *cache) unchanged(data []byte) bool {
+	_, err := os.Stat(c.path(data))
+	return err == nil
+}
+
+// setUnchanged remembers that the rules do not change the file
+func (c *cache) setUnchanged(data []byte) error {
+	path := c.path(data)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, nil, 0644)
+}
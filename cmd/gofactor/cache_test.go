@@ -0,0 +1,107 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// cacheRuleOpts writes before and after snippets to the directory and returns options using them
+func cacheRuleOpts(t *testing.T, dir, before, after string) options {
+	opts := options{before: filepath.Join(dir, "before.txt"), after: filepath.Join(dir, "after.txt")}
+	require.NoError(t, ioutil.WriteFile(opts.before, []byte(before), 0644))
+	require.NoError(t, ioutil.WriteFile(opts.after, []byte(after), 0644))
+	return opts
+}
+
+func TestCache(t *testing.T) {
+	dir := t.TempDir()
+	opts := cacheRuleOpts(t, dir, "X1++", "X1 += 1")
+	set, err := loadRuleSet(opts)
+	require.NoError(t, err)
+
+	c, err := newCache(filepath.Join(dir, "cache"), set.Hash())
+	require.NoError(t, err)
+	data := []byte("package main\n")
+	require.False(t, c.unchanged(data))
+	require.NoError(t, c.setUnchanged(data))
+	require.True(t, c.unchanged(data))
+	require.False(t, c.unchanged([]byte("package other\n")))
+
+	// a cache with the same rules and options hits
+	c2, err := newCache(c.dir, set.Hash())
+	require.NoError(t, err)
+	require.True(t, c2.unchanged(data))
+
+	// entries are invalidated by changes of rules
+	other, err := loadRuleSet(cacheRuleOpts(t, t.TempDir(), "X1++", "X1 = X1 + 1"))
+	require.NoError(t, err)
+	c2, err = newCache(c.dir, other.Hash())
+	require.NoError(t, err)
+	require.False(t, c2.unchanged(data))
+
+	// of options
+	for name, mod := range map[string]func(o *options){
+		"scopes":      func(o *options) { o.scopes = true },
+		"fixpoint":    func(o *options) { o.fixpoint = true },
+		"max-matches": func(o *options) { o.maxMatches = 1 },
+		"reverse":     func(o *options) { o.reverse = true },
+	} {
+		o := opts
+		mod(&o)
+		other, err := loadRuleSet(o)
+		require.NoError(t, err, name)
+		c2, err = newCache(c.dir, other.Hash())
+		require.NoError(t, err, name)
+		require.False(t, c2.unchanged(data), name)
+	}
+
+	// of gofactor version
+	c2, err = newCache(c.dir, set.Hash())
+	require.NoError(t, err)
+	c2.version += "-next"
+	require.False(t, c2.unchanged(data))
+
+	// and of the binary
+	c2, err = newCache(c.dir, set.Hash())
+	require.NoError(t, err)
+	require.NotEmpty(t, c2.build)
+	c2.build = "other"
+	require.False(t, c2.unchanged(data))
+}
+
+func TestRunCache(t *testing.T) {
+	dir := t.TempDir()
+	opts := cacheRuleOpts(t, dir, "X1++", "X1 += 1")
+	opts.cacheDir = filepath.Join(dir, "cache")
+	set, err := loadRuleSet(opts)
+	require.NoError(t, err)
+	c, err := newCache(opts.cacheDir, set.Hash())
+	require.NoError(t, err)
+
+	// files not changed by the rules are cached
+	const clean = "package main\n\nfunc main() {\n\ti += 1\n}\n"
+	path := filepath.Join(dir, "clean.go")
+	require.NoError(t, ioutil.WriteFile(path, []byte(clean), 0644))
+	require.NoError(t, run(opts, path))
+	require.True(t, c.unchanged([]byte(clean)))
+
+	// cached files are skipped
+	const matched = "package main\n\nfunc main() {\n\ti++\n}\n"
+	require.NoError(t, c.setUnchanged([]byte(matched)))
+	path = filepath.Join(dir, "matched.go")
+	require.NoError(t, ioutil.WriteFile(path, []byte(matched), 0644))
+	require.NoError(t, run(opts, path))
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, matched, string(data))
+
+	// and rewritten without the cache
+	opts.cacheDir = ""
+	require.NoError(t, run(opts, path))
+	data, err = ioutil.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, clean, string(data))
+}
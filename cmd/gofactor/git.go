@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// gitChangedFiles returns Go files changed relative to the revision, or staged in the index.
+// If both are set, staged changes are compared to the revision. Deleted files are not included.
+func gitChangedFiles(rev string, staged bool) ([]string, error) {
+	top, err := git("rev-parse", "--show-toplevel")
+	if err != nil {
+		return nil, err
+	}
+	top = strings.TrimSpace(top)
+
+	args := []string{"diff", "--name-only", "--diff-filter=ACMR", "-z"}
+	if staged {
+		args = append(args, "--cached")
+	}
+	if rev != "" {
+		args = append(args, rev)
+	}
+	out, err := git(args...)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, name := range strings.Split(out, "\x00") {
+		if strings.HasSuffix(name, ".go") {
+			files = append(files, filepath.Join(top, filepath.FromSlash(name)))
+		}
+	}
+	return files, nil
+}
+
+// gitStagedFile returns contents of the file staged in git index, the path is absolute
+func gitStagedFile(path string) ([]byte, error) {
+	top, err := git("rev-parse", "--show-toplevel")
+	if err != nil {
+		return nil, err
+	}
+	rel, err := filepath.Rel(strings.TrimSpace(top), path)
+	if err != nil {
+		return nil, err
+	}
+	out, err := git("show", ":"+filepath.ToSlash(rel))
+	if err != nil {
+		return nil, err
+	}
+	return []byte(out), nil
+}
+
+func git(args ...string) (string, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command("git", args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("git %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return string(out), nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStagedCheck(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	require.NoError(t, os.Chdir(dir))
+	defer os.Chdir(wd)
+
+	_, err = git("init", "-q")
+	require.NoError(t, err)
+
+	before, after := filepath.Join(dir, "before.txt"), filepath.Join(dir, "after.txt")
+	require.NoError(t, ioutil.WriteFile(before, []byte("X1++"), 0644))
+	require.NoError(t, ioutil.WriteFile(after, []byte("X1 += 1"), 0644))
+	opts := options{before: before, after: after, staged: true, check: true}
+
+	path := filepath.Join(dir, "main.go")
+	const (
+		matched = "package main\n\nfunc main() {\n\ti++\n}\n"
+		clean   = "package main\n\nfunc main() {\n\ti += 1\n}\n"
+	)
+
+	// the staged version is matched, the working tree is not
+	require.NoError(t, ioutil.WriteFile(path, []byte(matched), 0644))
+	_, err = git("add", "main.go")
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(path, []byte(clean), 0644))
+	require.EqualError(t, run(opts), "1 file(s) would be rewritten")
+
+	// the staged version is clean, the working tree is not
+	_, err = git("add", "main.go")
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(path, []byte(matched), 0644))
+	require.NoError(t, run(opts))
+
+	// files are never written in check mode
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, matched, string(data))
+}
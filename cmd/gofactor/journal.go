@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// journalDir is a directory where the journal of the last run is stored
+const journalDir = ".gofactor-undo"
+
+const manifestName = "manifest.json"
+
+// journal records original contents of the rewritten files, so the run can be undone
+type journal struct {
+	dir   string
+	Files []journalEntry `json:"files"`
+}
+
+type journalEntry struct {
+	// Path is an absolute path of the rewritten file
+	Path string `json:"path"`
+	// Backup is a name of the file with original contents inside the journal directory
+	Backup string `json:"backup"`
+}
+
+// newJournal starts a new journal in dir, the journal of the previous run is discarded
+func newJournal(dir string) (*journal, error) {
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	j := &journal{dir: dir}
+	return j, j.save()
+}
+
+// record saves original contents of the file. It must be called before the file is rewritten.
+func (j *journal) record(path string) error {
+	path, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return err
+	}
+	path, err = filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	e := journalEntry{Path: path, Backup: fmt.Sprintf("%06d", len(j.Files))}
+	if err := ioutil.WriteFile(filepath.Join(j.dir, e.Backup), data, 0644); err != nil {
+		return err
+	}
+	j.Files = append(j.Files, e)
+	// manifest is updated for each file, so an interrupted run can be undone as well
+	return j.save()
+}
+
+func (j *journal) save() error {
+	data, err := json.MarshalIndent(j, "", "\t")
+	if err != nil {
+		return err
+	}
+	return writeFile(filepath.Join(j.dir, manifestName), data)
+}
+
+// undo restores files recorded in the journal located in dir and removes the journal
+func undo(dir string) error {
+	data, err := ioutil.ReadFile(filepath.Join(dir, manifestName))
+	if os.IsNotExist(err) {
+		return errors.New("nothing to undo: journal " + dir + " not found")
+	} else if err != nil {
+		return err
+	}
+	var j journal
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	for _, e := range j.Files {
+		orig, err := ioutil.ReadFile(filepath.Join(dir, e.Backup))
+		if err != nil {
+			return err
+		}
+		if err := writeFile(e.Path, orig); err != nil {
+			return err
+		}
+	}
+	return os.RemoveAll(dir)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestJournal(t *testing.T) {
+	// the temporary directory may be a symlink itself
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	require.NoError(t, err)
+	jdir := filepath.Join(dir, journalDir)
+
+	// the journal of the previous run is discarded
+	require.NoError(t, os.MkdirAll(jdir, 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(jdir, "000000"), []byte("stale"), 0644))
+
+	a, b := filepath.Join(dir, "a.go"), filepath.Join(dir, "b.go")
+	require.NoError(t, ioutil.WriteFile(a, []byte("a"), 0644))
+	require.NoError(t, ioutil.WriteFile(b, []byte("b"), 0600))
+	require.NoError(t, os.Chmod(b, 0600))
+	// files are recorded by the paths of link targets
+	link := filepath.Join(dir, "link.go")
+	path := b
+	if err := os.Symlink(b, link); err == nil {
+		path = link
+	}
+
+	j, err := newJournal(jdir)
+	require.NoError(t, err)
+	_, err = os.Stat(filepath.Join(jdir, "000000"))
+	require.True(t, os.IsNotExist(err))
+
+	require.NoError(t, j.record(a))
+	require.NoError(t, writeFile(a, []byte("rewritten a")))
+	require.NoError(t, j.record(path))
+	require.NoError(t, writeFile(path, []byte("rewritten b")))
+
+	data, err := ioutil.ReadFile(filepath.Join(jdir, manifestName))
+	require.NoError(t, err)
+	var manifest journal
+	require.NoError(t, json.Unmarshal(data, &manifest))
+	require.Equal(t, []journalEntry{
+		{Path: a, Backup: "000000"},
+		{Path: b, Backup: "000001"},
+	}, manifest.Files)
+
+	require.NoError(t, undo(jdir))
+	for path, exp := range map[string]string{a: "a", b: "b"} {
+		data, err := ioutil.ReadFile(path)
+		require.NoError(t, err)
+		require.Equal(t, exp, string(data))
+	}
+	fi, err := os.Stat(b)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+
+	// the journal is removed after undo
+	_, err = os.Stat(jdir)
+	require.True(t, os.IsNotExist(err))
+	require.EqualError(t, undo(jdir), "nothing to undo: journal "+jdir+" not found")
+}
@@ -4,58 +4,323 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"go/build"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 
 	"github.com/lwsanty/gofactor"
 )
 
 var (
-	fSrc = flag.String("before", "", "path to a source sample")
-	fDst = flag.String("after", "", "path to a destination sample")
+	fSrc     = flag.String("before", "", "path to a source sample")
+	fDst     = flag.String("after", "", "path to a destination sample")
+	fRules   = flag.String("rules", "", "directory with rules, one subdirectory per rule with before, after and optional priority files")
+	fConf    = flag.Bool("conflicts", false, "report rules matching overlapping code in each file")
+	fTol     = flag.Bool("tolerant", false, "rewrite well-formed declarations of files with syntax errors and report the errors as warnings")
+	fScopes  = flag.Bool("scope-aware", false, "match identifiers by objects they refer to, so a metavariable never binds different variables of the same name")
+	fRev     = flag.Bool("reverse", false, "apply the rule in reverse direction (after -> before)")
+	fMax     = flag.Int("max-matches", 0, "maximal number of matches replaced in a single statement block, 0 replaces all matches")
+	fFix     = flag.Bool("fixpoint", false, "apply the rule repeatedly until the code stops changing")
+	fMaxIter = flag.Int("max-iterations", gofactor.DefaultMaxIterations, "maximal number of passes in fixpoint mode")
+	fEngine  = flag.String("engine", "uast", "rewrite engine: uast converts the whole file to UAST, ast matches Go AST directly and is faster")
+	fVerify  = flag.Bool("verify", false, "type-check rewritten packages and revert rewrites that introduce type errors")
+	fGen     = flag.Bool("generated", false, "rewrite generated files too")
+	fJournal = flag.Bool("journal", false, "record original contents of rewritten files to "+journalDir+", so the run can be reverted with 'gofactor undo'")
+	fSince   = flag.String("since", "", "also rewrite Go files changed relative to this git revision")
+	fStaged  = flag.Bool("staged", false, "also rewrite Go files staged in git index; with --check, staged contents are checked instead of the working tree")
+	fCheck   = flag.Bool("check", false, "do not write files, list files that would be rewritten and fail if there are any")
+	fCache   = flag.String("cache-dir", defaultCacheDir(), "directory to cache files not changed by the rules between runs")
+	fNoCache = flag.Bool("no-cache", false, "do not use the cache")
+	fClear   = flag.Bool("clear-cache", false, "remove all cache entries before the run")
+	fTags    = flag.String("tags", "", "comma-separated list of build tags; if set, files excluded by build constraints for current GOOS, GOARCH and these tags are skipped")
 )
 
+// options holds command line settings of a single run
+type options struct {
+	before, after string
+	// rules is a directory with rules, used instead of before and after
+	rules         string
+	conflicts     bool
+	tolerant      bool
+	scopes        bool
+	reverse       bool
+	maxMatches    int
+	fixpoint      bool
+	maxIterations int
+	engine        gofactor.Engine
+	verify        bool
+	generated     bool
+	journal       bool
+	since         string
+	staged        bool
+	check         bool
+	// cacheDir is empty if cache is disabled
+	cacheDir   string
+	clearCache bool
+	// build is set if files excluded by build constraints should be skipped
+	build *build.Context
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "undo" {
+		if err := undo(journalDir); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "verify-roundtrip" {
+		if err := verifyRoundTrip(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "rules" {
+		if err := rulesCmd(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "builtin" {
+		if err := builtinCmd(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
 	flag.Parse()
-	if err := run(*fSrc, *fDst, flag.Args()...); err != nil {
+	opts := options{
+		before:        *fSrc,
+		after:         *fDst,
+		rules:         *fRules,
+		conflicts:     *fConf,
+		tolerant:      *fTol,
+		scopes:        *fScopes,
+		reverse:       *fRev,
+		maxMatches:    *fMax,
+		fixpoint:      *fFix,
+		maxIterations: *fMaxIter,
+		verify:        *fVerify,
+		generated:     *fGen,
+		journal:       *fJournal,
+		since:         *fSince,
+		staged:        *fStaged,
+		check:         *fCheck,
+		cacheDir:      *fCache,
+		clearCache:    *fClear,
+	}
+	switch *fEngine {
+	case "uast":
+		opts.engine = gofactor.EngineUAST
+	case "ast":
+		opts.engine = gofactor.EngineAST
+	default:
+		fmt.Fprintf(os.Stderr, "unknown engine %q\n", *fEngine)
+		os.Exit(1)
+	}
+	if *fNoCache {
+		opts.cacheDir = ""
+	}
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "tags" {
+			opts.build = gofactor.BuildContext(strings.Split(*fTags, ",")...)
+		}
+	})
+	if err := run(opts, flag.Args()...); err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
 }
 
-func run(src, dst string, files ...string) error {
-	if src == "" {
+func run(opts options, files ...string) error {
+	if opts.rules != "" {
+		if opts.before != "" || opts.after != "" {
+			return errors.New("--rules can't be used together with --before and --after")
+		}
+	} else if opts.before == "" {
 		return errors.New("path to a source sample not specified (--before)")
-	} else if dst == "" {
+	} else if opts.after == "" {
 		return errors.New("path to a destination sample not specified (--after)")
+	}
+	// staged are files checked as they are staged in git index, not as they are in the working tree
+	staged := make(map[string]bool)
+	if opts.since != "" || opts.staged {
+		changed, err := gitChangedFiles(opts.since, opts.staged)
+		if err != nil {
+			return err
+		}
+		files = append(files, changed...)
+		for _, path := range changed {
+			staged[path] = opts.staged && opts.check
+		}
 	} else if len(files) == 0 {
 		return errors.New("specify at least one file to transform")
 	}
-	dsrc, err := ioutil.ReadFile(src)
+	set, err := loadRuleSet(opts)
 	if err != nil {
 		return err
 	}
-	ddst, err := ioutil.ReadFile(dst)
-	if err != nil {
-		return err
+	for _, w := range set.Warnings() {
+		fmt.Fprintln(os.Stderr, "warning:", w)
 	}
-	ref, err := gofactor.NewRefactor(string(dsrc), string(ddst))
-	if err != nil {
-		return err
+	var c *cache
+	if opts.cacheDir != "" {
+		if opts.clearCache {
+			if err := os.RemoveAll(opts.cacheDir); err != nil {
+				return err
+			}
+		}
+		c, err = newCache(opts.cacheDir, set.Hash())
+		if err != nil {
+			return err
+		}
 	}
+	// rewritten and original contents of the files by absolute path
+	results := make(map[string][]byte)
+	origs := make(map[string][]byte)
 	for _, path := range files {
-		data, err := ioutil.ReadFile(path)
+		if opts.build != nil {
+			ok, err := gofactor.MatchBuild(opts.build, path)
+			if err != nil {
+				return err
+			} else if !ok {
+				fmt.Fprintf(os.Stderr, "%s: skipped, excluded by build constraints\n", path)
+				continue
+			}
+		}
+		var data []byte
+		if staged[path] {
+			data, err = gitStagedFile(path)
+		} else {
+			data, err = ioutil.ReadFile(path)
+		}
 		if err != nil {
 			return err
 		}
-		out, err := ref.Apply(string(data))
+		if !opts.generated && gofactor.IsGenerated(data) {
+			fmt.Fprintf(os.Stderr, "%s: skipped, generated file\n", path)
+			continue
+		}
+		if c != nil && c.unchanged(data) {
+			continue
+		}
+		if opts.conflicts {
+			conflicts, err := set.Conflicts(string(data))
+			if err != nil && opts.tolerant {
+				fmt.Fprintf(os.Stderr, "%s: warning: conflicts not checked: %v\n", path, err)
+			} else if err != nil {
+				return fmt.Errorf("failed to check conflicts in %q: %v", path, err)
+			}
+			for _, conf := range conflicts {
+				conf.Pos[0].Filename, conf.Pos[1].Filename = path, path
+				fmt.Fprintln(os.Stderr, conf)
+			}
+		}
+		out, changed, err := set.Rewrite(string(data))
+		var serr *gofactor.SyntaxError
+		if errors.As(err, &serr) {
+			for _, e := range serr.Errors {
+				fmt.Fprintf(os.Stderr, "%s:%d:%d: warning: %s\n", path, e.Pos.Line, e.Pos.Column, e.Msg)
+			}
+			err = nil
+		}
 		if err != nil {
 			return fmt.Errorf("failed to transform %q: %v", path, err)
+		} else if !changed {
+			if c != nil {
+				if err := c.setUnchanged(data); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return err
+		}
+		results[abs] = []byte(out)
+		origs[abs] = data
+	}
+	if opts.verify {
+		rule := fmt.Sprintf("%s -> %s", opts.before, opts.after)
+		if opts.rules != "" {
+			rule = opts.rules
+		} else if opts.reverse {
+			rule = fmt.Sprintf("%s -> %s", opts.after, opts.before)
+		}
+		if err := verify(results, origs, set, rule); err != nil {
+			return err
+		}
+	}
+	if opts.check {
+		if len(results) == 0 {
+			return nil
+		}
+		paths := make([]string, 0, len(results))
+		for path := range results {
+			paths = append(paths, path)
 		}
-		err = ioutil.WriteFile(path, []byte(out), 0644)
+		sort.Strings(paths)
+		for _, path := range paths {
+			fmt.Println(path)
+		}
+		return fmt.Errorf("%d file(s) would be rewritten", len(results))
+	}
+	var j *journal
+	if opts.journal && len(results) != 0 {
+		j, err = newJournal(journalDir)
 		if err != nil {
 			return err
 		}
 	}
+	for path, out := range results {
+		if j != nil {
+			if err := j.record(path); err != nil {
+				return err
+			}
+		}
+		if err := writeFile(path, out); err != nil {
+			return err
+		}
+	}
 	return nil
 }
+
+// loadRuleSet creates a rule set from the rules directory or from before and after snippets
+func loadRuleSet(opts options) (*gofactor.RuleSet, error) {
+	ropts := []gofactor.Option{gofactor.MaxMatches(opts.maxMatches)}
+	sopts := []gofactor.Option{gofactor.WithEngine(opts.engine)}
+	if opts.tolerant {
+		sopts = append(sopts, gofactor.Tolerant())
+	}
+	if opts.scopes {
+		sopts = append(sopts, gofactor.ScopeAware())
+	}
+	if opts.fixpoint {
+		sopts = append(sopts, gofactor.Fixpoint(opts.maxIterations))
+	}
+	var rules []*gofactor.Refactor
+	if opts.rules != "" {
+		var err error
+		rules, err = loadRules(opts.rules, ropts...)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		r, err := loadRule(opts.before, opts.after, ropts...)
+		if err != nil {
+			return nil, err
+		}
+		rules = []*gofactor.Refactor{r}
+	}
+	set := gofactor.NewRuleSet(rules, sopts...)
+	if opts.reverse {
+		return set.Inverse()
+	}
+	return set, nil
+}
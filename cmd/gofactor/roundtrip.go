@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/lwsanty/gofactor/golang"
+)
+
+// verifyRoundTrip converts Go files to UAST and back without any rule and reports files that have changed.
+// Directories are walked recursively, testdata directories are skipped.
+func verifyRoundTrip(paths []string) error {
+	if len(paths) == 0 {
+		return errors.New("usage: gofactor verify-roundtrip <file or dir>...")
+	}
+	var files []string
+	for _, path := range paths {
+		err := filepath.Walk(path, func(path string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if fi.IsDir() {
+				if fi.Name() == "testdata" {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if strings.HasSuffix(path, ".go") {
+				files = append(files, path)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	failed := 0
+	for _, path := range files {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		want, got, err := golang.RoundTrip(string(data))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+			failed++
+			continue
+		}
+		if line, a, b, ok := firstDiff(want, got); ok {
+			fmt.Printf("%s: printed line %d differs after round trip:\n\t- %s\n\t+ %s\n", path, line, a, b)
+			failed++
+		}
+	}
+	if failed != 0 {
+		return fmt.Errorf("%d of %d file(s) failed", failed, len(files))
+	}
+	return nil
+}
+
+// firstDiff returns the number and contents of the first differing line of two texts
+func firstDiff(a, b string) (int, string, string, bool) {
+	al, bl := strings.Split(a, "\n"), strings.Split(b, "\n")
+	for i := 0; i < len(al) || i < len(bl); i++ {
+		var x, y string
+		if i < len(al) {
+			x = al[i]
+		}
+		if i < len(bl) {
+			y = bl[i]
+		}
+		if x != y || i >= len(al) || i >= len(bl) {
+			return i + 1, x, y, true
+		}
+	}
+	return 0, "", "", false
+}
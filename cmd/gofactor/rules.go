@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/lwsanty/gofactor"
+)
+
+// loadRule reads before and after snippets from files and creates a rule
+func loadRule(before, after string, opts ...gofactor.Option) (*gofactor.Refactor, error) {
+	dsrc, err := ioutil.ReadFile(before)
+	if err != nil {
+		return nil, err
+	}
+	ddst, err := ioutil.ReadFile(after)
+	if err != nil {
+		return nil, err
+	}
+	return gofactor.NewRefactor(string(dsrc), string(ddst), opts...)
+}
+
+// loadRules loads rules from the directory. Each subdirectory is a rule named after it, with the snippets in
+// "before" and "after" files and an optional integer priority in "priority" file.
+func loadRules(dir string, opts ...gofactor.Option) ([]*gofactor.Refactor, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var rules []*gofactor.Refactor
+	for _, fi := range infos {
+		if !fi.IsDir() {
+			continue
+		}
+		name := fi.Name()
+		path := filepath.Join(dir, name)
+		ropts := append([]gofactor.Option{gofactor.Named(name)}, opts...)
+
+		data, err := ioutil.ReadFile(filepath.Join(path, "priority"))
+		if err == nil {
+			prio, err := strconv.Atoi(strings.TrimSpace(string(data)))
+			if err != nil {
+				return nil, fmt.Errorf("rule %s: invalid priority: %v", name, err)
+			}
+			ropts = append(ropts, gofactor.Priority(prio))
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+
+		r, err := loadRule(filepath.Join(path, "before"), filepath.Join(path, "after"), ropts...)
+		if err != nil {
+			return nil, fmt.Errorf("rule %s: %v", name, err)
+		}
+		rules = append(rules, r)
+	}
+	if len(rules) == 0 {
+		return nil, fmt.Errorf("no rules found in %q", dir)
+	}
+	return rules, nil
+}
+
+// rulesCmd runs 'gofactor rules' subcommands
+func rulesCmd(args []string) error {
+	if len(args) != 2 || args[0] != "lint" {
+		return errors.New("usage: gofactor rules lint <dir>")
+	}
+	rules, err := loadRules(args[1])
+	if err != nil {
+		return err
+	}
+	set := gofactor.NewRuleSet(rules)
+	for _, w := range set.Warnings() {
+		fmt.Fprintln(os.Stderr, "warning:", w)
+	}
+	problems, err := set.Lint()
+	if err != nil {
+		return err
+	}
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+	if len(problems) != 0 {
+		return fmt.Errorf("%d problem(s) found", len(problems))
+	}
+	return nil
+}
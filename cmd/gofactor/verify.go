@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"go/types"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/lwsanty/gofactor"
+)
+
+// maxDiffLines limits the size of the changed part of a file the line diff is computed for, positions in larger parts
+// are mapped to the beginning of the part
+const maxDiffLines = 2000
+
+// verify type-checks packages of the rewritten files and reverts rewrites that introduce new type errors.
+// Results and original contents of the files are keyed by absolute file path, reverted files are removed from results.
+// Rewrites of packages that can't be loaded are reverted as well.
+func verify(results, origs map[string][]byte, set *gofactor.RuleSet, rule string) error {
+	byDir := make(map[string][]string)
+	for path := range results {
+		dir := filepath.Dir(path)
+		byDir[dir] = append(byDir[dir], path)
+	}
+	for dir, paths := range byDir {
+		sort.Strings(paths)
+		base, err := gofactor.TypeErrors(dir, nil)
+		if err != nil {
+			revertPackage(results, paths, err)
+			continue
+		}
+		for {
+			overlay := make(map[string][]byte)
+			for _, path := range paths {
+				if data, ok := results[path]; ok {
+					overlay[path] = data
+				}
+			}
+			if len(overlay) == 0 {
+				break
+			}
+			cur, err := gofactor.TypeErrors(dir, overlay)
+			if err != nil {
+				revertPackage(results, paths, err)
+				break
+			}
+			reverted := false
+			for _, path := range paths {
+				out, ok := overlay[path]
+				if !ok {
+					continue
+				}
+				orig := origs[path]
+				lines := func(line int) (int, bool) {
+					return origLine(orig, out, line)
+				}
+				if errs := gofactor.NewTypeErrors(base[path], cur[path], lines); len(errs) != 0 {
+					revert(results, origs, set, path, rule, errs[0])
+					reverted = true
+				}
+			}
+			if reverted {
+				// reverting a file may fix errors in other files, check again
+				continue
+			}
+			// rewritten files are fine, but other files of the package got broken,
+			// there is no way to tell which rewrite caused it, so revert all of them
+			for path, errs := range cur {
+				if _, ok := overlay[path]; ok {
+					continue
+				}
+				if errs := gofactor.NewTypeErrors(base[path], errs, nil); len(errs) != 0 {
+					for _, p := range paths {
+						if _, ok := overlay[p]; ok {
+							revert(results, origs, set, p, rule, errs[0])
+						}
+					}
+					break
+				}
+			}
+			break
+		}
+	}
+	return nil
+}
+
+// revertPackage drops rewrites of the files of a package that can't be type-checked
+func revertPackage(results map[string][]byte, paths []string, err error) {
+	for _, path := range paths {
+		if _, ok := results[path]; ok {
+			delete(results, path)
+			fmt.Fprintf(os.Stderr, "%s: rewrite reverted, package can't be type-checked: %v\n", path, err)
+		}
+	}
+}
+
+// revert drops the rewrite of the file and reports the type error it caused with the position in the original file,
+// and the match of the rule that rewrote the code
+func revert(results, origs map[string][]byte, set *gofactor.RuleSet, path, rule string, cause types.Error) {
+	out, orig := results[path], origs[path]
+	delete(results, path)
+
+	pos := cause.Fset.Position(cause.Pos)
+	line, col := pos.Line, pos.Column
+	if pos.Filename == path {
+		var exact bool
+		line, exact = origLine(orig, out, line)
+		if !exact {
+			col = 1
+		}
+	}
+	msg := fmt.Sprintf("%s:%d:%d: rewrite reverted, rule %s introduces type errors: %s", pos.Filename, line, col, rule, cause.Msg)
+	if pos.Filename != path {
+		msg = fmt.Sprintf("%s: rewrite reverted, rule %s introduces type errors in other files: %s:%d:%d: %s",
+			path, rule, pos.Filename, line, col, cause.Msg)
+		line = 0
+	}
+	if m, ok := findMatch(set, orig, line); ok {
+		if len(set.Rules()) > 1 {
+			msg += fmt.Sprintf(" (rule %s matched at %s:%d:%d)", m.Rule, path, m.Pos.Line, m.Pos.Column)
+		} else {
+			msg += fmt.Sprintf(" (matched at %s:%d:%d)", path, m.Pos.Line, m.Pos.Column)
+		}
+	}
+	fmt.Fprintln(os.Stderr, msg)
+}
+
+// findMatch returns the match of the rules in the original code that contains the line, or the last one before it,
+// or the first one if the line is zero or there are no matches before it
+func findMatch(set *gofactor.RuleSet, orig []byte, line int) (gofactor.Match, bool) {
+	matches, err := set.Matches(string(orig))
+	if err != nil || len(matches) == 0 {
+		return gofactor.Match{}, false
+	}
+	res := matches[0]
+	for _, m := range matches {
+		if m.Pos.Line > line {
+			break
+		}
+		res = m
+		if line <= m.End.Line {
+			break
+		}
+	}
+	return res, true
+}
+
+// origLine maps the line of the rewritten code to the original code. Lines of unchanged code are mapped exactly,
+// lines of rewritten code are mapped to the first original line they replaced, and exact is false then.
+func origLine(orig, out []byte, line int) (int, bool) {
+	a, b := strings.Split(string(orig), "\n"), strings.Split(string(out), "\n")
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	if line <= prefix {
+		return line, true
+	} else if line > len(b)-suffix {
+		return line - len(b) + len(a), true
+	}
+
+	// longest common subsequence of the changed parts
+	a, b = a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+	if len(a) > maxDiffLines || len(b) > maxDiffLines {
+		return prefix + 1, false
+	}
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	// after is the original line following the last common line before the target one
+	target, after := line-prefix-1, 0
+	for i, j := 0, 0; i < len(a) && j < len(b) && j <= target; {
+		switch {
+		case a[i] == b[j]:
+			if j == target {
+				return prefix + i + 1, true
+			}
+			i, j = i+1, j+1
+			after = i
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			i++
+		default:
+			j++
+		}
+	}
+	return prefix + after + 1, false
+}
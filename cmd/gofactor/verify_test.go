@@ -0,0 +1,77 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/lwsanty/gofactor"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOrigLine(t *testing.T) {
+	const (
+		orig = "a\nb\nc\nd\ne\n"
+		out  = "a\nx\ny\nc\nd\nz\ne\n"
+	)
+	cases := []struct {
+		line, exp int
+		exact     bool
+	}{
+		{line: 1, exp: 1, exact: true},
+		{line: 2, exp: 2},
+		{line: 3, exp: 2},
+		{line: 4, exp: 3, exact: true},
+		{line: 5, exp: 4, exact: true},
+		{line: 6, exp: 5},
+		{line: 7, exp: 5, exact: true},
+	}
+	for _, c := range cases {
+		line, exact := origLine([]byte(orig), []byte(out), c.line)
+		require.Equal(t, c.exp, line, "line %d", c.line)
+		require.Equal(t, c.exact, exact, "line %d", c.line)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "main.go")
+	const orig = "package main\n\nimport \"fmt\"\n\nfunc main() {\n\ts := \"a\"\n\tn := 1\n\tfmt.Println(s, n)\n}\n"
+	require.NoError(t, ioutil.WriteFile(path, []byte(orig), 0644))
+
+	r, err := gofactor.NewRefactor("fmt.Println(X1, X2)", "fmt.Println(X1 - X2)")
+	require.NoError(t, err)
+	set := gofactor.NewRuleSet([]*gofactor.Refactor{r})
+	out, err := set.Apply(orig)
+	require.NoError(t, err)
+
+	results := map[string][]byte{path: []byte(out)}
+	origs := map[string][]byte{path: []byte(orig)}
+	require.NoError(t, verify(results, origs, set, "rule"))
+	require.Empty(t, results)
+
+	m, ok := findMatch(set, []byte(orig), 8)
+	require.True(t, ok)
+	require.Equal(t, 8, m.Pos.Line)
+	require.Equal(t, 2, m.Pos.Column)
+}
+
+func TestVerifyBrokenPackage(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "main.go")
+	const orig = "package main\n\nfunc main() {\n\ti := 1\n\ti++\n}\n"
+	require.NoError(t, ioutil.WriteFile(path, []byte(orig), 0644))
+	// another file of the package can't be parsed
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "broken.go"), []byte("package main\n\nfunc {\n"), 0644))
+
+	r, err := gofactor.NewRefactor("X1++", "X1 += 1")
+	require.NoError(t, err)
+	set := gofactor.NewRuleSet([]*gofactor.Refactor{r})
+	out, err := set.Apply(orig)
+	require.NoError(t, err)
+
+	results := map[string][]byte{path: []byte(out)}
+	origs := map[string][]byte{path: []byte(orig)}
+	require.NoError(t, verify(results, origs, set, "rule"))
+	require.Empty(t, results)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// writeFile atomically replaces the file contents: data is written to a temporary file in the same directory,
+// which is then renamed over the original one. Symlinks are resolved, so the link target is replaced.
+// The mode of the original file is preserved, new files are created with 0644 mode.
+func writeFile(path string, data []byte) error {
+	mode := os.FileMode(0644)
+	if p, err := filepath.EvalSymlinks(path); err == nil {
+		fi, err := os.Stat(p)
+		if err != nil {
+			return err
+		}
+		path, mode = p, fi.Mode().Perm()
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".gofactor")
+	if err != nil {
+		return err
+	}
+	// no-op if the file was renamed
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
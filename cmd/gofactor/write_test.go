@@ -0,0 +1,63 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "main.go")
+	require.NoError(t, ioutil.WriteFile(path, []byte("old"), 0644))
+	require.NoError(t, os.Chmod(path, 0600))
+
+	require.NoError(t, writeFile(path, []byte("new")))
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, "new", string(data))
+
+	// the mode is preserved
+	fi, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+
+	// temporary files are renamed over the original one
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+
+	// new files are created
+	created := filepath.Join(dir, "new.go")
+	require.NoError(t, writeFile(created, []byte("data")))
+	fi, err = os.Stat(created)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0644), fi.Mode().Perm())
+}
+
+func TestWriteFileSymlink(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "target.go")
+	require.NoError(t, ioutil.WriteFile(target, []byte("old"), 0640))
+	require.NoError(t, os.Chmod(target, 0640))
+	link := filepath.Join(dir, "link.go")
+	if err := os.Symlink(target, link); err != nil {
+		t.Skip("symlinks are not supported:", err)
+	}
+
+	require.NoError(t, writeFile(link, []byte("new")))
+
+	// the link is kept, its target is replaced
+	fi, err := os.Lstat(link)
+	require.NoError(t, err)
+	require.True(t, fi.Mode()&os.ModeSymlink != 0)
+	data, err := ioutil.ReadFile(target)
+	require.NoError(t, err)
+	require.Equal(t, "new", string(data))
+	fi, err = os.Stat(target)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0640), fi.Mode().Perm())
+}
@@ -0,0 +1,260 @@
+package gofactor
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/printer"
+	"go/token"
+	"reflect"
+	"sort"
+
+	"github.com/bblfsh/sdk/v3/uast"
+	"github.com/bblfsh/sdk/v3/uast/nodes"
+	"github.com/bblfsh/sdk/v3/uast/transformer"
+)
+
+// dispatcher applies a list of rules in a single tree traversal.
+// Rules are indexed by the type of the first statement of their before snippets, so only candidate rules are tested
+// for each statement block. Candidate rules are applied in order, each one to the result of the previous one.
+type dispatcher struct {
+	rules []*Refactor
+	// byType maps statement type to indexes of rules that start with this statement
+	byType map[string][]int
+	// flips enables detection of rules that cancel each other
+	flips bool
+}
+
+func newDispatcher(rules []*Refactor, conf config) *dispatcher {
+	d := &dispatcher{
+		rules:  rules,
+		byType: make(map[string][]int),
+		flips:  conf.maxIterations > 0,
+	}
+	for i, r := range rules {
+		typ := stmtTypeName(r.stmts[0])
+		d.byType[typ] = append(d.byType[typ], i)
+	}
+	return d
+}
+
+func stmtTypeName(stmt ast.Stmt) string {
+	return reflect.TypeOf(stmt).Elem().Name()
+}
+
+// next returns the index of the first rule after the rule i that may match a block with statements of the given
+// types, or -1 if there is none
+func (d *dispatcher) next(types map[string]struct{}, i int) int {
+	res := -1
+	for typ := range types {
+		idx := d.byType[typ]
+		if j := sort.SearchInts(idx, i+1); j < len(idx) && (res < 0 || idx[j] < res) {
+			res = idx[j]
+		}
+	}
+	return res
+}
+
+// nodeTypes returns types of statements of the UAST block and reports whether it holds top-level declarations
+func nodeTypes(arr nodes.Array) (map[string]struct{}, bool) {
+	types := make(map[string]struct{})
+	topLevel := false
+	for _, el := range arr {
+		if obj, ok := el.(nodes.Object); ok {
+			types[uast.TypeOf(obj)] = struct{}{}
+			if _, ok := obj[topLevelKey]; ok {
+				topLevel = true
+			}
+		}
+	}
+	return types, topLevel
+}
+
+// stmtTypes returns types of statements of the list
+func stmtTypes(list []ast.Stmt) map[string]struct{} {
+	types := make(map[string]struct{})
+	for _, stmt := range list {
+		types[stmtTypeName(stmt)] = struct{}{}
+	}
+	return types
+}
+
+// flipError is returned when a rule turns a statement block back to a state produced by a previous rule
+func (d *dispatcher) flipError(prev, cur int) error {
+	if prev < 0 {
+		return fmt.Errorf("rules do not converge: rule %s reverts changes of other rules", ruleName(d.rules, cur))
+	}
+	return fmt.Errorf("rules do not converge: rule %s reverts changes of rule %s", ruleName(d.rules, cur), ruleName(d.rules, prev))
+}
+
+// topLevelKey marks top-level declarations wrapped into statements, only rules of declarations match them
+const topLevelKey = "@toplevel"
+
+// wrapDeclNodes wraps top-level declarations of the file into declaration statements, like wrapDecls does
+func wrapDeclNodes(file nodes.Node) nodes.Node {
+	obj, ok := file.(nodes.Object)
+	if !ok {
+		return file
+	}
+	decls, _ := obj["Decls"].(nodes.Array)
+	stmts := make(nodes.Array, 0, len(decls))
+	for _, decl := range decls {
+		stmts = append(stmts, nodes.Object{
+			uast.KeyType: nodes.String("DeclStmt"),
+			"Decl":       decl,
+			topLevelKey:  nodes.Bool(true),
+		})
+	}
+	obj = obj.CloneObject()
+	obj["Decls"] = stmts
+	return obj
+}
+
+// unwrapDeclNodes returns declarations of the file wrapped by wrapDeclNodes
+func unwrapDeclNodes(file nodes.Node) (nodes.Node, error) {
+	obj, ok := file.(nodes.Object)
+	if !ok {
+		return file, nil
+	}
+	stmts, _ := obj["Decls"].(nodes.Array)
+	decls := make(nodes.Array, 0, len(stmts))
+	for _, n := range stmts {
+		stmt, ok := n.(nodes.Object)
+		if !ok || uast.TypeOf(stmt) != "DeclStmt" {
+			return nil, fmt.Errorf("unexpected top-level statement %s", uast.TypeOf(n))
+		}
+		decls = append(decls, stmt["Decl"])
+	}
+	obj = obj.CloneObject()
+	obj["Decls"] = decls
+	return obj, nil
+}
+
+// transform applies the rules once to every statement block of the UAST tree and reports whether it has changed.
+// Top-level declarations are matched by rules of declarations as well.
+func (d *dispatcher) transform(n nodes.Node) (nodes.Node, bool, error) {
+	var errs []error
+	nn, changed := nodes.Apply(wrapDeclNodes(n), func(n nodes.Node) (nodes.Node, bool) {
+		arr, ok := n.(nodes.Array)
+		if !ok {
+			return n, false
+		}
+		types, topLevel := nodeTypes(arr)
+		var (
+			applied bool
+			// seen maps hashes of states of the block to the rule that produced it
+			seen map[nodes.Hash]int
+		)
+		if d.flips {
+			seen = map[nodes.Hash]int{nodes.HashOf(arr): -1}
+		}
+		var cur nodes.Node = arr
+		// statements produced by a rule may be matched by the following rules, so types are updated after each change
+		for i := d.next(types, -1); i >= 0; i = d.next(types, i) {
+			if topLevel && !d.rules[i].decls {
+				continue
+			}
+			nn, ok, err := d.rules[i].transformArr(cur.(nodes.Array))
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			} else if !ok {
+				continue
+			}
+			if seen != nil {
+				h := nodes.HashOf(nn)
+				if prev, ok := seen[h]; ok && !nodes.Equal(nn, cur) {
+					errs = append(errs, d.flipError(prev, i))
+					return n, false
+				}
+				seen[h] = i
+			}
+			cur, applied = nn, true
+			types, _ = nodeTypes(nn.(nodes.Array))
+		}
+		return cur, applied
+	})
+	if err := transformer.NewMultiError(errs...); err != nil {
+		return nil, false, err
+	}
+	nn, err := unwrapDeclNodes(nn)
+	if err != nil {
+		return nil, false, err
+	}
+	return nn, changed, nil
+}
+
+// transformAST applies the rules once to every statement list of the file and reports whether the file has changed.
+// Lists are processed bottom-up, the same way UAST engine does, top-level declarations are processed last.
+func (d *dispatcher) transformAST(f *ast.File, fs *token.FileSet) (bool, error) {
+	lists := stmtLists(f)
+	changed := false
+	// nested lists are always found after the parent one
+	for i := len(lists) - 1; i >= 0; i-- {
+		ok, err := d.transformList(lists[i], fs, false)
+		if err != nil {
+			return false, err
+		}
+		changed = changed || ok
+	}
+
+	decls := wrapDecls(f.Decls)
+	ok, err := d.transformList(&decls, fs, true)
+	if err != nil {
+		return false, err
+	} else if ok {
+		f.Decls, err = unwrapDecls(decls)
+		if err != nil {
+			return false, err
+		}
+	}
+	return changed || ok, nil
+}
+
+// transformList applies the rules to the statement list, if topLevel is set, the list holds top-level declarations
+// and only rules of declarations are applied
+func (d *dispatcher) transformList(list *[]ast.Stmt, fs *token.FileSet, topLevel bool) (bool, error) {
+	types := stmtTypes(*list)
+	var (
+		applied bool
+		// seen maps printed states of the list to the rule that produced it
+		seen map[string]int
+	)
+	if d.flips {
+		seen = map[string]int{printStmts(*list): -1}
+	}
+	// statements produced by a rule may be matched by the following rules, so types are updated after each change
+	for i := d.next(types, -1); i >= 0; i = d.next(types, i) {
+		if topLevel && !d.rules[i].decls {
+			continue
+		}
+		prev := *list
+		ok, err := d.rules[i].transformList(list, fs)
+		if err != nil {
+			return false, err
+		} else if !ok {
+			continue
+		}
+		if seen != nil {
+			s := printStmts(*list)
+			if p, ok := seen[s]; ok && s != printStmts(prev) {
+				return false, d.flipError(p, i)
+			}
+			seen[s] = i
+		}
+		applied = true
+		types = stmtTypes(*list)
+	}
+	return applied, nil
+}
+
+// printStmts prints statements without positions, it is used to compare states of statement lists
+func printStmts(stmts []ast.Stmt) string {
+	buf := &bytes.Buffer{}
+	for _, stmt := range stmts {
+		// positions of original and replaced statements are mixed, so the empty file set is used
+		_ = printer.Fprint(buf, token.NewFileSet(), stmt)
+		buf.WriteByte('\n')
+	}
+	return buf.String()
+}
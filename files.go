@@ -0,0 +1,49 @@
+package gofactor
+
+import (
+	"go/build"
+	"go/parser"
+	"go/token"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var generatedRe = regexp.MustCompile(`^// Code generated .* DO NOT EDIT\.$`)
+
+// IsGenerated reports whether the source is generated, i.e. it has a "// Code generated ... DO NOT EDIT." comment
+// before the package clause. See https://golang.org/s/generatedcode for details.
+func IsGenerated(src []byte) bool {
+	f, err := parser.ParseFile(token.NewFileSet(), "", src, parser.PackageClauseOnly|parser.ParseComments)
+	if err != nil {
+		return false
+	}
+	for _, g := range f.Comments {
+		if g.Pos() > f.Package {
+			break
+		}
+		for _, c := range g.List {
+			if generatedRe.MatchString(c.Text) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// BuildContext returns the default build context (GOOS, GOARCH and other settings are taken from environment)
+// extended with the given build tags.
+func BuildContext(tags ...string) *build.Context {
+	ctx := build.Default
+	for _, tag := range tags {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			ctx.BuildTags = append(ctx.BuildTags, tag)
+		}
+	}
+	return &ctx
+}
+
+// MatchBuild reports whether the file is included in the build by its name and build constraints.
+func MatchBuild(ctx *build.Context, path string) (bool, error) {
+	return ctx.MatchFile(filepath.Dir(path), filepath.Base(path))
+}
@@ -0,0 +1,19 @@
+package main
+
+import "fmt"
+
+func check(op string, err error) error {
+	switch op {
+	case "read":
+		if err != nil {
+			return err
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown op %s", op)
+	}
+}
+
+func main() {
+	fmt.Println(check("read", nil))
+}
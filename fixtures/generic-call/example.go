@@ -0,0 +1,15 @@
+package main
+
+import "fmt"
+
+func Convert[From, To any](v From) (To, bool) {
+	res, ok := any(v).(To)
+	return res, ok
+}
+
+func main() {
+	a, ok := Convert[int, string](1)
+	fmt.Println(a, ok)
+	var b, ok2 = Convert[string, int]("b")
+	fmt.Println(b, ok2)
+}
@@ -0,0 +1,21 @@
+package main
+
+import "fmt"
+
+func Max[T interface{ ~int | ~int64 | ~float64 }](a, b T) T {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func Min[T interface{ ~int | ~int64 | ~float64 }](a, b T) T {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func main() {
+	fmt.Println(Max(1, 2), Min(1.5, 2.5))
+}
@@ -0,0 +1,18 @@
+package main
+
+import "fmt"
+
+type Set[T any] struct {
+	items []T
+}
+
+type Pair[K comparable, V any] struct {
+	Key   K
+	Value V
+}
+
+func main() {
+	s := Set[int]{items: []int{1, 2}}
+	p := Pair[string, int]{Key: "a", Value: 1}
+	fmt.Println(s, p)
+}
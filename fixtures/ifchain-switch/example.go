@@ -0,0 +1,30 @@
+package main
+
+import "fmt"
+
+func describe(code int) string {
+	if code == 200 {
+		return "ok"
+	} else if code == 404 {
+		return "not found"
+	} else if code == 500 {
+		msg := "server error"
+		return msg
+	} else {
+		return "unknown"
+	}
+}
+
+func compare(a, b int) string {
+	if a == 1 {
+		return "one"
+	} else if b == 2 {
+		return "two"
+	} else {
+		return "other"
+	}
+}
+
+func main() {
+	fmt.Println(describe(404), compare(1, 2))
+}
@@ -0,0 +1,18 @@
+package main
+
+import (
+	"fmt"
+	iu "io/ioutil"
+)
+
+func main() {
+	data, err := iu.ReadFile("a.txt")
+	if err != nil {
+		panic(err)
+	}
+	ioutil := struct {
+		ReadFile func(string) ([]byte, error)
+	}{iu.ReadFile}
+	other, err := ioutil.ReadFile("b.txt")
+	fmt.Println(string(data), string(other), err)
+}
@@ -0,0 +1,14 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+)
+
+func main() {
+	data, err := ioutil.ReadFile("file.txt")
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(string(data))
+}
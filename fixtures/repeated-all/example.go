@@ -0,0 +1,22 @@
+package main
+
+import "fmt"
+
+func main() {
+	i := 0
+	i++
+	i++
+	i++
+	i++
+	i++
+	i++
+	i++
+	fmt.Println(i)
+}
+
+func a(j int) int {
+	j++
+	j++
+	j++
+	return j
+}
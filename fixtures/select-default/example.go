@@ -0,0 +1,16 @@
+package main
+
+import "fmt"
+
+func poll(errs chan error) error {
+	select {
+	case err := <-errs:
+		return err
+	}
+}
+
+func main() {
+	errs := make(chan error, 1)
+	errs <- fmt.Errorf("failed")
+	fmt.Println(poll(errs))
+}
@@ -0,0 +1,27 @@
+package main
+
+import "fmt"
+
+func main() {
+	for _, s := range []string{"a", "b", "c", "d"} {
+		switch s {
+		case "a":
+			fmt.Println("first")
+		case "b":
+			fmt.Println("second")
+		case "c":
+			fmt.Println("third")
+			fmt.Println("last")
+		}
+		switch s {
+		case "a":
+			fmt.Println("only")
+		}
+		switch s {
+		case "a", "b":
+			fmt.Println("many")
+		default:
+			fmt.Println("none")
+		}
+	}
+}
@@ -0,0 +1,20 @@
+package main
+
+import "fmt"
+
+func name(n int) string {
+	switch n {
+	case 0:
+		return "none"
+	case 1:
+		return "few"
+	case 2:
+		return "few"
+	default:
+		return "many"
+	}
+}
+
+func main() {
+	fmt.Println(name(1))
+}
@@ -0,0 +1,16 @@
+package main
+
+import "fmt"
+
+func kind(v any) string {
+	switch v.(type) {
+	default:
+		return "unknown"
+	case int:
+		return "int"
+	}
+}
+
+func main() {
+	fmt.Println(kind(1))
+}
@@ -0,0 +1,92 @@
+package gofactor
+
+import (
+	"go/ast"
+	"go/types"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/bblfsh/sdk/v3/uast"
+	"github.com/bblfsh/sdk/v3/uast/nodes"
+	"github.com/bblfsh/sdk/v3/uast/transformer"
+)
+
+const (
+	// freshPrefix starts metavariables of after snippets that construct fresh identifiers, the rest of the name is
+	// the base name of the identifier
+	freshPrefix = "X_"
+	// placeholderPrefix starts names of fresh identifiers until they get their final names
+	placeholderPrefix = "$"
+)
+
+// placeholders is the number of fresh identifiers constructed by all rules
+var placeholders int64
+
+func isFreshVar(name string) bool {
+	return strings.HasPrefix(name, freshPrefix)
+}
+
+// opFresh constructs an identifier that gets a name not used in the file after the rewrite, see nameFresh. All occurrences of
+// the metavariable in a single match construct the same identifier.
+type opFresh string
+
+func (op opFresh) Kinds() nodes.Kind {
+	return nodes.KindObject
+}
+
+func (op opFresh) Check(st *transformer.State, n nodes.Node) (bool, error) {
+	return false, nil
+}
+
+func (op opFresh) Construct(st *transformer.State, n nodes.Node) (nodes.Node, error) {
+	if n != nil {
+		return nil, transformer.ErrUnexpectedNode.New(n)
+	}
+	if id, ok := st.GetVar(string(op)); ok {
+		return id, nil
+	}
+	base := strings.TrimPrefix(string(op), freshPrefix)
+	num := atomic.AddInt64(&placeholders, 1)
+	id := nodes.Object{
+		uast.KeyType: nodes.String("Ident"),
+		"Name":       nodes.String(placeholderPrefix + base + placeholderPrefix + strconv.FormatInt(num, 10)),
+	}
+	if err := st.SetVar(string(op), id); err != nil {
+		return nil, err
+	}
+	return id, nil
+}
+
+// nameFresh gives fresh identifiers of the tree names that are not used by any other identifier of the tree and are
+// not predeclared. Names are assigned in order of appearance: the base name first, then the base name with a number.
+// Other files of the package are not known, so package-level names declared there may be shadowed or redeclared.
+func nameFresh(n ast.Node) {
+	used := make(map[string]bool)
+	ast.Inspect(n, func(n ast.Node) bool {
+		if id, ok := n.(*ast.Ident); ok && !strings.HasPrefix(id.Name, placeholderPrefix) {
+			used[id.Name] = true
+		}
+		return true
+	})
+
+	names := make(map[string]string)
+	ast.Inspect(n, func(n ast.Node) bool {
+		id, ok := n.(*ast.Ident)
+		if !ok || !strings.HasPrefix(id.Name, placeholderPrefix) {
+			return true
+		}
+		name, ok := names[id.Name]
+		if !ok {
+			base := strings.SplitN(id.Name, placeholderPrefix, 3)[1]
+			name = base
+			for i := 1; used[name] || types.Universe.Lookup(name) != nil; i++ {
+				name = base + strconv.Itoa(i)
+			}
+			used[name] = true
+			names[id.Name] = name
+		}
+		id.Name = name
+		return true
+	})
+}
@@ -1,11 +1,19 @@
 module github.com/lwsanty/gofactor
 
-go 1.13
+go 1.18
 
 require (
 	github.com/bblfsh/sdk/v3 v3.3.1
-	github.com/gogo/protobuf v1.3.1 // indirect
 	github.com/stretchr/testify v1.4.0
+)
+
+require (
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/gogo/protobuf v1.3.1 // indirect
+	github.com/golang/protobuf v1.3.1 // indirect
+	github.com/pkg/errors v0.8.1 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	gopkg.in/src-d/go-errors.v1 v1.0.0 // indirect
 	gopkg.in/yaml.v2 v2.2.4 // indirect
 )
 
@@ -57,6 +57,7 @@ func init() {
 	registerType("ImportSpec", ast.ImportSpec{})
 	registerType("IncDecStmt", ast.IncDecStmt{})
 	registerType("IndexExpr", ast.IndexExpr{})
+	registerType("IndexListExpr", ast.IndexListExpr{})
 	registerType("InterfaceType", ast.InterfaceType{})
 	registerType("KeyValueExpr", ast.KeyValueExpr{})
 	registerType("LabeledStmt", ast.LabeledStmt{})
@@ -1,8 +1,11 @@
 package golang
 
 import (
+	"bytes"
 	"go/ast"
+	"go/format"
 	"go/parser"
+	"go/printer"
 	"go/token"
 	"reflect"
 
@@ -25,3 +28,72 @@ func Parse(code string) (nodes.Node, error) {
 	}
 	return ValueToNode(reflect.ValueOf(f), fs)
 }
+
+// ClearPositions sets all positions in the tree to token.NoPos
+func ClearPositions(n ast.Node) {
+	clearPositions(reflect.ValueOf(n))
+}
+
+func clearPositions(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		// scopes and objects may form cycles
+		if v.IsNil() || v.Type() == ScopeType || v.Type() == ObjectType {
+			return
+		}
+		clearPositions(v.Elem())
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			f := v.Field(i)
+			if f.Type() == PosType {
+				f.SetInt(int64(token.NoPos))
+				continue
+			}
+			clearPositions(f)
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			clearPositions(v.Index(i))
+		}
+	}
+}
+
+// RoundTrip converts the code to UAST and back, and returns the original and the converted files printed the same
+// way: without positions and comments, and formatted. The conversion is lossless if both are equal.
+func RoundTrip(code string) (string, string, error) {
+	// comments are not parsed at all: Doc and Comment fields of nodes would be printed in wrong places without positions
+	fs := token.NewFileSet()
+	f, err := parser.ParseFile(fs, "input.go", code, 0)
+	if err != nil {
+		return "", "", err
+	}
+
+	n, err := ValueToNode(reflect.ValueOf(f), fs)
+	if err != nil {
+		return "", "", err
+	}
+	conv := NodeToAST(n)
+
+	ClearPositions(f)
+	orig, err := printNode(f)
+	if err != nil {
+		return "", "", err
+	}
+	res, err := printNode(conv)
+	if err != nil {
+		return "", "", err
+	}
+	return orig, res, nil
+}
+
+func printNode(n ast.Node) (string, error) {
+	buf := &bytes.Buffer{}
+	if err := printer.Fprint(buf, token.NewFileSet(), n); err != nil {
+		return "", err
+	}
+	out, err := format.Source(buf.Bytes())
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
@@ -59,6 +59,7 @@ var tokens = map[string]Token{
 	"}":           RBRACE,
 	";":           SEMICOLON,
 	":":           COLON,
+	"~":           TILDE,
 	"break":       BREAK,
 	"case":        CASE,
 	"chan":        CHAN,
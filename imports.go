@@ -0,0 +1,388 @@
+package gofactor
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// qualifierPrefix starts names of package qualifiers replaced by import paths, it can't appear in Go identifiers
+const qualifierPrefix = "@"
+
+// imports returns package names declared by the rules, mapped to import paths
+func (d *dispatcher) imports() map[string]string {
+	res := make(map[string]string)
+	for _, r := range d.rules {
+		for name, path := range r.conf.imports {
+			res[name] = path
+		}
+	}
+	return res
+}
+
+// qualify replaces package qualifiers of selector expressions with qualifierPrefix followed by the import path,
+// if the path is declared by the rules, so the rules match packages by path regardless of their local names.
+// It returns local names of the replaced packages by path.
+func (d *dispatcher) qualify(f *ast.File) map[string]string {
+	declared := make(map[string]struct{})
+	for _, path := range d.imports() {
+		declared[path] = struct{}{}
+	}
+	byName := make(map[string]string)
+	names := make(map[string]string)
+	for _, s := range f.Imports {
+		path := importPath(s)
+		if _, ok := declared[path]; !ok || !isRemovable(s) {
+			continue
+		}
+		name := importName(s)
+		byName[name] = path
+		if _, ok := names[path]; !ok {
+			names[path] = name
+		}
+	}
+	if len(byName) != 0 {
+		qualifyNames(f, byName)
+	}
+	return names
+}
+
+// qualifyNames replaces package qualifiers found in names with qualifierPrefix followed by the import path.
+// Identifiers resolved to local declarations are not package qualifiers and are left as is.
+func qualifyNames(n ast.Node, names map[string]string) {
+	ast.Inspect(n, func(n ast.Node) bool {
+		if sel, ok := n.(*ast.SelectorExpr); ok {
+			if id, ok := sel.X.(*ast.Ident); ok && id.Obj == nil {
+				if path, ok := names[id.Name]; ok {
+					id.Name = qualifierPrefix + path
+				}
+			}
+		}
+		return true
+	})
+}
+
+// unqualify restores package qualifiers replaced by qualify. Packages not imported by the file get names
+// declared by the rules.
+func (d *dispatcher) unqualify(n ast.Node, names map[string]string) {
+	declared := make(map[string]string)
+	for name, path := range d.imports() {
+		declared[path] = name
+	}
+	ast.Inspect(n, func(n ast.Node) bool {
+		if id, ok := n.(*ast.Ident); ok && strings.HasPrefix(id.Name, qualifierPrefix) {
+			path := strings.TrimPrefix(id.Name, qualifierPrefix)
+			if name, ok := names[path]; ok {
+				id.Name = name
+			} else {
+				id.Name = declared[path]
+			}
+		}
+		return true
+	})
+}
+
+// splitImports separates import declarations at the beginning of the snippet from its statements and returns
+// imported packages by name
+func splitImports(snippet string) (map[string]string, string, error) {
+	const header = "package p\n"
+	fs := token.NewFileSet()
+	f, err := parser.ParseFile(fs, "", header+snippet, parser.ImportsOnly)
+	if err != nil || len(f.Imports) == 0 {
+		// statements are parsed and checked later
+		return nil, snippet, nil
+	}
+	imports := make(map[string]string)
+	for _, s := range f.Imports {
+		if !isRemovable(s) {
+			return nil, "", fmt.Errorf("import of %s: blank, dot and cgo imports are not supported in snippets", s.Path.Value)
+		}
+		imports[importName(s)] = importPath(s)
+	}
+	end := fs.Position(f.Decls[len(f.Decls)-1].End()).Offset - len(header)
+	return imports, snippet[end:], nil
+}
+
+// fixImports adds imports for packages the rewritten code refers to, and removes imports that became unused.
+// Only qualifiers that appeared or disappeared with the rewrite are considered, thus imports of a file that
+// was already broken are left as is. Package paths are looked up in known names first, then in the standard library.
+// Imports of packages in used are never removed, they are used by code the rules don't see.
+func fixImports(orig, code string, known map[string]string, used map[string]struct{}) (string, error) {
+	fs := token.NewFileSet()
+	of, err := parser.ParseFile(fs, "", orig, parser.ParseComments)
+	if err != nil {
+		return "", err
+	}
+	f, err := parser.ParseFile(fs, "", code, 0)
+	if err != nil {
+		return "", err
+	}
+	before, after := qualifiers(of), qualifiers(f)
+
+	var (
+		kept     []*ast.ImportSpec
+		imported = make(map[string]struct{})
+	)
+	for _, s := range of.Imports {
+		name := importName(s)
+		_, inUse := after[name]
+		if _, ok := used[name]; ok {
+			inUse = true
+		}
+		if !inUse && isRemovable(s) {
+			if _, ok := before[name]; ok {
+				continue
+			}
+		}
+		imported[name] = struct{}{}
+		kept = append(kept, s)
+	}
+
+	var added []*ast.ImportSpec
+	for name := range after {
+		if _, ok := before[name]; ok {
+			continue
+		} else if _, ok := imported[name]; ok {
+			continue
+		}
+		path, ok := known[name]
+		if !ok {
+			path, ok = stdlib[name]
+		}
+		if !ok {
+			continue
+		}
+		s := &ast.ImportSpec{Path: &ast.BasicLit{Kind: token.STRING, Value: strconv.Quote(path)}}
+		if importPathToName(path) != name {
+			s.Name = ast.NewIdent(name)
+		}
+		added = append(added, s)
+	}
+	if len(kept) == len(of.Imports) && len(added) == 0 {
+		return code, nil
+	}
+	sort.Slice(added, func(i, j int) bool {
+		return importPath(added[i]) < importPath(added[j])
+	})
+
+	// rules don't change imports, so they are taken from the original code with their grouping and comments
+	groups := importGroups(fs, of, orig, kept)
+	for _, s := range added {
+		groups = addImport(groups, s)
+	}
+
+	// import declarations are replaced by a single declaration with all imports
+	var start, end int
+	for _, decl := range f.Decls {
+		gd, ok := decl.(*ast.GenDecl)
+		if !ok || gd.Tok != token.IMPORT {
+			break
+		}
+		if end == 0 {
+			start = fs.Position(gd.Pos()).Offset
+		}
+		end = fs.Position(gd.End()).Offset
+	}
+	if end == 0 {
+		start = fs.Position(f.Name.End()).Offset
+		end = start
+	}
+
+	buf := &bytes.Buffer{}
+	buf.WriteString(code[:start])
+	if end == start {
+		buf.WriteString("\n\n")
+	}
+	writeImports(buf, groups)
+	buf.WriteString(code[end:])
+
+	out, err := format.Source(buf.Bytes())
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
+
+// qualifiers returns names used as qualifiers of selector expressions that are not resolved in the file,
+// i.e. names that refer to imported packages
+func qualifiers(n ast.Node) map[string]struct{} {
+	res := make(map[string]struct{})
+	ast.Inspect(n, func(n ast.Node) bool {
+		if sel, ok := n.(*ast.SelectorExpr); ok {
+			if id, ok := sel.X.(*ast.Ident); ok && id.Obj == nil {
+				res[id.Name] = struct{}{}
+			}
+		}
+		return true
+	})
+	return res
+}
+
+// isRemovable reports whether the import may be removed when it is not used: blank, dot and cgo imports are never removed
+func isRemovable(s *ast.ImportSpec) bool {
+	if s.Name != nil && (s.Name.Name == "_" || s.Name.Name == ".") {
+		return false
+	}
+	return importPath(s) != "C"
+}
+
+func importPath(s *ast.ImportSpec) string {
+	path, err := strconv.Unquote(s.Path.Value)
+	if err != nil {
+		return s.Path.Value
+	}
+	return path
+}
+
+// importName returns the name the import is referred to in the file
+func importName(s *ast.ImportSpec) string {
+	if s.Name != nil {
+		return s.Name.Name
+	}
+	return importPathToName(importPath(s))
+}
+
+// importPathToName returns the package name assumed from the import path, the same way goimports does:
+// version suffixes and "go-" prefix are ignored
+func importPathToName(path string) string {
+	base := path
+	if i := strings.LastIndex(base, "/"); i >= 0 {
+		base = base[i+1:]
+		if isVersion(base) && i > 0 {
+			base = path[:i]
+			if j := strings.LastIndex(base, "/"); j >= 0 {
+				base = base[j+1:]
+			}
+		}
+	}
+	if strings.HasPrefix(path, "gopkg.in/") {
+		if i := strings.Index(base, ".v"); i > 0 {
+			base = base[:i]
+		}
+	}
+	base = strings.TrimPrefix(base, "go-")
+	if i := strings.IndexFunc(base, func(r rune) bool {
+		return !(r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9')
+	}); i >= 0 {
+		base = base[:i]
+	}
+	return base
+}
+
+// isVersion reports whether the path element is a major version suffix, like v2
+func isVersion(s string) bool {
+	if len(s) < 2 || s[0] != 'v' {
+		return false
+	}
+	_, err := strconv.Atoi(s[1:])
+	return err == nil
+}
+
+// isStdlib reports whether the import path belongs to the standard library
+func isStdlib(path string) bool {
+	elem := path
+	if i := strings.Index(path, "/"); i >= 0 {
+		elem = path[:i]
+	}
+	return !strings.Contains(elem, ".")
+}
+
+// importLine is the source of an import spec with its comments
+type importLine struct {
+	path string
+	src  string
+}
+
+// importGroups returns sources of the import specs split into groups separated by blank lines
+func importGroups(fs *token.FileSet, f *ast.File, code string, specs []*ast.ImportSpec) [][]importLine {
+	keep := make(map[*ast.ImportSpec]struct{})
+	for _, s := range specs {
+		keep[s] = struct{}{}
+	}
+	var (
+		groups [][]importLine
+		last   = -1
+	)
+	// groups are computed for all imports, so a removed import does not split its group
+	for _, s := range f.Imports {
+		pos, end := s.Pos(), s.End()
+		if s.Doc != nil {
+			pos = s.Doc.Pos()
+		}
+		if s.Comment != nil {
+			end = s.Comment.End()
+		}
+		line := fs.Position(pos).Line
+		if last < 0 || line > last+1 {
+			groups = append(groups, nil)
+		}
+		last = fs.Position(end).Line
+		if _, ok := keep[s]; !ok {
+			continue
+		}
+		src := code[fs.Position(pos).Offset:fs.Position(end).Offset]
+		groups[len(groups)-1] = append(groups[len(groups)-1], importLine{path: importPath(s), src: src})
+	}
+	res := groups[:0]
+	for _, g := range groups {
+		if len(g) != 0 {
+			res = append(res, g)
+		}
+	}
+	return res
+}
+
+// addImport adds the import to the first group with imports of the same kind (standard library or not)
+// keeping the group sorted, or to a new group: standard library imports go first, others go last
+func addImport(groups [][]importLine, s *ast.ImportSpec) [][]importLine {
+	path := importPath(s)
+	src := s.Path.Value
+	if s.Name != nil {
+		src = s.Name.Name + " " + src
+	}
+	line := importLine{path: path, src: src}
+	std := isStdlib(path)
+	for i, g := range groups {
+		if isStdlib(g[0].path) != std {
+			continue
+		}
+		j := sort.Search(len(g), func(j int) bool {
+			return g[j].path > path
+		})
+		g = append(g, importLine{})
+		copy(g[j+1:], g[j:])
+		g[j] = line
+		groups[i] = g
+		return groups
+	}
+	if std {
+		return append([][]importLine{{line}}, groups...)
+	}
+	return append(groups, []importLine{line})
+}
+
+func writeImports(buf *bytes.Buffer, groups [][]importLine) {
+	switch {
+	case len(groups) == 0:
+		return
+	case len(groups) == 1 && len(groups[0]) == 1 && !strings.Contains(groups[0][0].src, "\n"):
+		buf.WriteString("import " + groups[0][0].src)
+		return
+	}
+	buf.WriteString("import (\n")
+	for i, g := range groups {
+		if i > 0 {
+			buf.WriteString("\n")
+		}
+		for _, l := range g {
+			buf.WriteString("\t" + l.src + "\n")
+		}
+	}
+	buf.WriteString(")")
+}
@@ -0,0 +1,166 @@
+package gofactor
+
+import (
+	"fmt"
+	"go/scanner"
+	"go/token"
+	"strings"
+	"sync"
+
+	"github.com/bblfsh/sdk/v3/uast"
+	"github.com/bblfsh/sdk/v3/uast/nodes"
+	"github.com/bblfsh/sdk/v3/uast/transformer"
+)
+
+const (
+	// opMarker starts references to custom operations, $X1:name, calls of template functions, $name(...), and
+	// markers of repeated branches, $repeat(...), in snippets
+	opMarker = "$"
+	// opSeparator separates the metavariable and the operation name in identifiers the references are replaced with,
+	// it is a letter, so the result is a valid identifier
+	opSeparator = "ǀ"
+)
+
+// OpFunc returns a custom operation used in place of the metavariable with given name. Like vartransform.Var,
+// the operation is responsible for binding the metavariable in Check and for constructing the node in Construct.
+type OpFunc func(name string) transformer.Op
+
+var ops = struct {
+	sync.RWMutex
+	m map[string]OpFunc
+}{m: make(map[string]OpFunc)}
+
+// RegisterOp registers a custom operation under the name. Snippets refer to the operation as $X1:name, where X1 is
+// the metavariable passed to fn. Registering the name again replaces the operation, rules keep operations that were
+// registered when they were created.
+func RegisterOp(name string, fn OpFunc) error {
+	if !token.IsIdentifier(name) {
+		return fmt.Errorf("invalid operation name %q", name)
+	} else if fn == nil {
+		return fmt.Errorf("operation %s is nil", name)
+	}
+	ops.Lock()
+	defer ops.Unlock()
+	ops.m[name] = fn
+	return nil
+}
+
+func lookupOp(name string) (OpFunc, bool) {
+	ops.RLock()
+	defer ops.RUnlock()
+	fn, ok := ops.m[name]
+	return fn, ok
+}
+
+// splitOp returns the metavariable and the name of the custom operation the identifier refers to
+func splitOp(ident string) (string, string, bool) {
+	i := strings.Index(ident, opSeparator)
+	if i < 0 {
+		return ident, "", false
+	}
+	return ident[:i], ident[i+len(opSeparator):], true
+}
+
+// varName returns the name of the metavariable, without a reference to a custom operation
+func varName(ident string) string {
+	name, _, _ := splitOp(ident)
+	return name
+}
+
+// expandOps replaces references to custom operations, names of called template functions and markers of repeated
+// branches with identifiers, so the snippet can be parsed
+func expandOps(snippet string) (string, error) {
+	if !strings.Contains(snippet, opMarker) {
+		return snippet, nil
+	}
+	type tok struct {
+		off int
+		tok token.Token
+		lit string
+	}
+	fs := token.NewFileSet()
+	file := fs.AddFile("", -1, len(snippet))
+	var s scanner.Scanner
+	// errors are reported by the parser later
+	s.Init(file, []byte(snippet), nil, 0)
+	var toks []tok
+	for {
+		pos, t, lit := s.Scan()
+		if t == token.EOF {
+			break
+		}
+		if t == token.COLON {
+			lit = ":"
+		}
+		toks = append(toks, tok{off: file.Offset(pos), tok: t, lit: lit})
+	}
+
+	var (
+		buf  strings.Builder
+		last int
+	)
+	for i, t := range toks {
+		if t.tok != token.ILLEGAL || t.lit != opMarker {
+			continue
+		}
+		ref := toks[i:]
+		if len(ref) >= 3 && ref[1].tok == token.IDENT && ref[2].tok == token.LPAREN &&
+			ref[1].off == t.off+1 && ref[2].off == ref[1].off+len(ref[1].lit) {
+			if ref[1].lit == repeatName {
+				buf.WriteString(snippet[last:t.off])
+				buf.WriteString(repeatFunc)
+				last = ref[1].off + len(ref[1].lit)
+				continue
+			}
+			if _, ok := templateFuncs[ref[1].lit]; !ok {
+				return "", fmt.Errorf("%v: unknown template function %s", fs.Position(file.Pos(t.off)), ref[1].lit)
+			}
+			buf.WriteString(snippet[last:t.off])
+			buf.WriteString(templatePrefix + ref[1].lit)
+			last = ref[1].off + len(ref[1].lit)
+			continue
+		}
+		if len(ref) < 4 || ref[1].tok != token.IDENT || ref[2].tok != token.COLON || ref[3].tok != token.IDENT ||
+			ref[1].off != t.off+1 || ref[2].off != ref[1].off+len(ref[1].lit) || ref[3].off != ref[2].off+1 {
+			return "", fmt.Errorf("%v: custom operations are referenced as $X1:name, template functions are called as $name(...) and repeated branches are marked with $repeat(...)",
+				fs.Position(file.Pos(t.off)))
+		}
+		if !isMetaVar(ref[1].lit) || isFreshVar(ref[1].lit) {
+			return "", fmt.Errorf("%v: custom operation %s is applied to %s, which is not a metavariable",
+				fs.Position(file.Pos(t.off)), ref[3].lit, ref[1].lit)
+		}
+		buf.WriteString(snippet[last:t.off])
+		buf.WriteString(ref[1].lit + opSeparator + ref[3].lit)
+		last = ref[3].off + len(ref[3].lit)
+	}
+	buf.WriteString(snippet[last:])
+	return buf.String(), nil
+}
+
+// checkOps checks that custom operations used by the snippet are registered
+func checkOps(n nodes.Node) error {
+	switch o := n.(type) {
+	case nodes.Object:
+		if uast.TypeOf(o) == "Ident" {
+			name, _ := o["Name"].(nodes.String)
+			if _, op, ok := splitOp(string(name)); ok {
+				if _, ok := lookupOp(op); !ok {
+					return fmt.Errorf("custom operation %s is not registered", op)
+				}
+			}
+			return nil
+		}
+		for _, v := range o {
+			if err := checkOps(v); err != nil {
+				return err
+			}
+		}
+	case nodes.Array:
+		for _, v := range o {
+			if err := checkOps(v); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
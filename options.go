@@ -0,0 +1,131 @@
+package gofactor
+
+// DefaultMaxIterations is the iteration limit used by Fixpoint if the limit is not set
+const DefaultMaxIterations = 100
+
+// Engine is an implementation of rules matching and rewriting
+type Engine int
+
+const (
+	// EngineUAST converts the whole file to UAST and applies the rules to it
+	EngineUAST Engine = iota
+	// EngineAST matches rules directly against Go AST and converts only matched statements to UAST and back
+	EngineAST
+)
+
+// Option configures a Refactor or a RuleSet
+type Option func(*config)
+
+type config struct {
+	// maxMatches is the maximal number of matches replaced in a single statement block, zero means no limit
+	maxMatches int
+	// maxIterations is the maximal number of passes in fixpoint mode, zero disables fixpoint mode
+	maxIterations int
+	engine        Engine
+	// name and priority are only used by rules in a RuleSet
+	name     string
+	priority int
+	// imports maps package names used in the after snippet to import paths
+	imports map[string]string
+	// tolerant enables rewriting of files with syntax errors
+	tolerant bool
+	// scopes enables comparison of identifiers by objects they refer to
+	scopes bool
+}
+
+func newConfig(opts []Option) config {
+	var c config
+	for _, opt := range opts {
+		opt(&c)
+	}
+	return c
+}
+
+// AllMatches replaces all non-overlapping leftmost matches in each statement block. This is the default strategy.
+func AllMatches() Option {
+	return MaxMatches(0)
+}
+
+// FirstMatch replaces only the leftmost match in each statement block.
+func FirstMatch() Option {
+	return MaxMatches(1)
+}
+
+// MaxMatches replaces at most n non-overlapping leftmost matches in each statement block.
+// If n is zero, all matches are replaced.
+func MaxMatches(n int) Option {
+	return func(c *config) {
+		if n < 0 {
+			n = 0
+		}
+		c.maxMatches = n
+	}
+}
+
+// Fixpoint applies rules repeatedly until the tree stops changing, making at most maxIterations passes.
+// If maxIterations is zero, DefaultMaxIterations is used.
+// Rules that never converge, or turn the tree back to one of the previous states, cause an error.
+func Fixpoint(maxIterations int) Option {
+	return func(c *config) {
+		if maxIterations <= 0 {
+			maxIterations = DefaultMaxIterations
+		}
+		c.maxIterations = maxIterations
+	}
+}
+
+// WithEngine sets the engine used to apply the rules. Both engines produce the same results, but AST engine
+// is faster for large files.
+func WithEngine(e Engine) Option {
+	return func(c *config) {
+		c.engine = e
+	}
+}
+
+// Named sets a name of the rule that is used in reports.
+func Named(name string) Option {
+	return func(c *config) {
+		c.name = name
+	}
+}
+
+// Priority sets a priority of the rule in a RuleSet. Rules with higher priority are applied first,
+// rules with the same priority are applied in order. Default priority is zero.
+func Priority(p int) Option {
+	return func(c *config) {
+		c.priority = p
+	}
+}
+
+// Imports declares packages the snippets refer to, mapping package names used in the snippets to import paths.
+// Selectors of declared packages match by import path, whatever name the file imports the package with, and never
+// match local variables of the same name; the after snippet uses the name the file imports the package with.
+// Rewritten files get imports for these packages if the rewrite introduced them. Snippets may declare packages
+// with import declarations at the beginning as well.
+func Imports(imports map[string]string) Option {
+	return func(c *config) {
+		if c.imports == nil {
+			c.imports = make(map[string]string)
+		}
+		for name, path := range imports {
+			c.imports[name] = path
+		}
+	}
+}
+
+// Tolerant allows rewriting files with syntax errors: rules are applied only to well-formed declarations, and
+// declarations with errors are left as is. Syntax errors are returned as *SyntaxError together with the result.
+func Tolerant() Option {
+	return func(c *config) {
+		c.tolerant = true
+	}
+}
+
+// ScopeAware makes identifiers equal only if they refer to the same declared object, so a metavariable bound twice
+// never matches two different variables of the same name, e.g. a shadowed variable and the outer one, or a variable
+// and a field. Objects are resolved within the file, identifiers declared in other files are compared by name.
+func ScopeAware() Option {
+	return func(c *config) {
+		c.scopes = true
+	}
+}
@@ -1,12 +1,16 @@
 package gofactor
 
 import (
-	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
-	"go/format"
-	"go/printer"
+	"go/ast"
 	"go/token"
 	"io/ioutil"
+	"reflect"
+	"regexp"
+	"sort"
 	"strings"
 
 	"github.com/bblfsh/sdk/v3/uast"
@@ -24,16 +28,43 @@ func main() {
 	%s
 }`
 
+// declTemplate is prepended to snippets of declarations
+const declTemplate = "package main\n\n"
+
+// clauseTemplates wrap snippets of case clauses, clauses of type switches are parsed as ones of a switch
+var clauseTemplates = []string{"switch {\n%s\n}", "select {\n%s\n}"}
+
+// clauseSnippet matches snippets of case clauses
+var clauseSnippet = regexp.MustCompile(`^\s*(case|default)\b`)
+
 type Refactor struct {
 	before string
 	after  string
-	m      transformer.Transformer
+	opts   []Option
+	conf   config
+	in     transformer.Op
+	out    transformer.Op
+	// inArr and outArr match and construct a window of statements
+	inArr  transformer.ArrayOp
+	outArr transformer.ArrayOp
+	// stmts is the before snippet as Go AST, AST engine uses it as a fast pre-check
+	stmts []ast.Stmt
+	fs    *token.FileSet
+	// decls is set if the snippets are declarations, the rule matches both local and top-level declarations then
+	decls bool
+	// d applies the rule to the whole tree
+	d *dispatcher
+	// tokens are identifiers and literals from before snippet, the code can't match if it doesn't contain any of them
+	tokens   []string
+	warnings []string
 }
 
-func NewRefactor(before, after string) (*Refactor, error) {
+func NewRefactor(before, after string, opts ...Option) (*Refactor, error) {
 	r := &Refactor{
 		before: before,
 		after:  after,
+		opts:   opts,
+		conf:   newConfig(opts),
 	}
 
 	if err := r.prepare(); err != nil {
@@ -43,12 +74,18 @@ func NewRefactor(before, after string) (*Refactor, error) {
 }
 
 func (r *Refactor) prepare() error {
-	in, err := parseNodeHack(r.before)
+	before, after, err := r.declareImports()
 	if err != nil {
 		return err
 	}
 
-	out, err := parseNodeHack(r.after)
+	r.decls = isDeclSnippet(before)
+	stmts, fs, in, err := parseNodeHack(before, r.conf.imports, r.decls)
+	if err != nil {
+		return err
+	}
+
+	_, _, out, err := parseNodeHack(after, r.conf.imports, r.decls)
 	if err != nil {
 		return err
 	}
@@ -57,44 +94,195 @@ func (r *Refactor) prepare() error {
 	// dump(in, "../out/1.yml")
 	// dump(out, "../out/2.yml")
 
+	if err := r.validate(in, out); err != nil {
+		return err
+	}
+	r.tokens = requiredTokens(in)
+	if r.decls {
+		// top-level declarations are marked by wrapDeclNodes, the rule matches both marked and local declarations
+		for _, n := range in.(nodes.Array) {
+			n.(nodes.Object)[topLevelKey] = nodes.Bool(true)
+		}
+	}
+
+	r.stmts, r.fs = stmts, fs
+	rep, err := newRepeats(in, out)
+	if err != nil {
+		return err
+	}
+	r.inArr = nodeToOp(in, rep, templateVars(out)).(transformer.ArrayOp)
+	r.outArr = nodeToOp(out, rep, nil).(transformer.ArrayOp)
+
 	// left side always does Check and the right side performs Construct
-	matrOpIn := &matroshka.MatroshkaArray{nodeToOp(in).(transformer.ArrayOp)}
-	matrOpOut := &matroshka.MatroshkaArray{nodeToOp(out).(transformer.ArrayOp)}
+	r.in = &matroshka.MatroshkaArray{Op: r.inArr, Limit: r.conf.maxMatches}
+	r.out = &matroshka.MatroshkaArray{Op: r.outArr}
+	r.d = newDispatcher([]*Refactor{r}, r.conf)
+	return nil
+}
+
+// declareImports adds packages imported by headers of the snippets to the packages declared with Imports option,
+// and returns the snippets without headers, with references to custom operations expanded
+func (r *Refactor) declareImports() (string, string, error) {
+	imports := make(map[string]string)
+	for name, path := range r.conf.imports {
+		imports[name] = path
+	}
+	var snippets [2]string
+	for i, snippet := range []string{r.before, r.after} {
+		snippet, err := expandOps(snippet)
+		if err != nil {
+			return "", "", err
+		}
+		header, body, err := splitImports(snippet)
+		if err != nil {
+			return "", "", err
+		}
+		for name, path := range header {
+			if prev, ok := imports[name]; ok && prev != path {
+				return "", "", fmt.Errorf("package name %s is declared for both %q and %q", name, prev, path)
+			}
+			imports[name] = path
+		}
+		snippets[i] = body
+	}
+	if len(imports) != 0 {
+		r.conf.imports = imports
+	}
+	return snippets[0], snippets[1], nil
+}
+
+// validate checks that the rule is well-formed and collects warnings for suspicious rules
+func (r *Refactor) validate(in, out nodes.Node) error {
+	if arr, _ := in.(nodes.Array); len(arr) == 0 {
+		return errors.New("before snippet does not contain any statements")
+	}
+
+	inVars, outVars := metaVars(in), metaVars(out)
+	if err := checkBodyVars(in, out); err != nil {
+		return err
+	}
+	if err := checkTemplates(in, out); err != nil {
+		return err
+	}
+	if err := checkOps(nodes.Array{in, out}); err != nil {
+		return err
+	}
 
-	r.m = transformer.Mappings(transformer.Map(matrOpIn, matrOpOut))
+	for name := range inVars {
+		if isFreshVar(name) {
+			return fmt.Errorf("fresh identifier %s can only be used in after snippet", name)
+		}
+	}
+	var unbound []string
+	for name := range outVars {
+		if isFreshVar(name) {
+			if name == freshPrefix {
+				return fmt.Errorf("fresh identifier %s has no base name", name)
+			}
+			continue
+		}
+		if _, ok := inVars[name]; !ok {
+			unbound = append(unbound, name)
+		}
+	}
+	if len(unbound) != 0 {
+		sort.Strings(unbound)
+		return fmt.Errorf("metavariables are not bound by before snippet: %s", strings.Join(unbound, ", "))
+	}
+
+	var once []string
+	for name, cnt := range inVars {
+		if _, ok := outVars[name]; !ok && cnt == 1 {
+			once = append(once, name)
+		}
+	}
+	sort.Strings(once)
+	for _, name := range once {
+		r.warnings = append(r.warnings, fmt.Sprintf("metavariable %s is bound only once and never used: it matches any node", name))
+	}
+
+	if nodes.Equal(in, out) {
+		r.warnings = append(r.warnings, "before and after snippets are equal: rule is a no-op")
+	}
 	return nil
 }
 
-func (r *Refactor) Apply(code string) (string, error) {
-	test, err := golang.Parse(code)
+// Inverse returns a refactor that undoes the current one by swapping before and after snippets
+func (r *Refactor) Inverse() (*Refactor, error) {
+	inv, err := NewRefactor(r.after, r.before, r.opts...)
 	if err != nil {
-		return "", err
+		return nil, fmt.Errorf("rule is not invertible: %v", err)
 	}
+	return inv, nil
+}
+
+// Hash returns a digest of the rule and its options that can be used as a cache key
+func (r *Refactor) Hash() string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%q\n%q\n%+v\n", r.before, r.after, r.conf)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Name returns the name of the rule set by Named option
+func (r *Refactor) Name() string {
+	return r.conf.name
+}
 
-	test, err = trimPositions(test)
+// Subsumes reports whether the before snippet of the rule matches the whole before snippet of the other rule,
+// i.e. all code matched by the other rule is matched by this rule as well. Matches of a part of the snippet or of
+// nested statements are overlaps, not subsumption.
+func (r *Refactor) Subsumes(other *Refactor) (bool, error) {
+	if len(r.stmts) != len(other.stmts) {
+		return false, nil
+	}
+	starts, _, err := r.match(other.stmts, other.fs, 1)
 	if err != nil {
-		return "", err
+		return false, err
 	}
+	return len(starts) != 0, nil
+}
 
-	// debug
-	// dump(test, "../out/test.yml")
+// Warnings returns non-fatal problems found in the rule during construction
+func (r *Refactor) Warnings() []string {
+	return r.warnings
+}
 
-	res, err := r.m.Do(test)
-	if err != nil {
-		return "", err
+// Apply applies the rule to the code. If nothing matched, the code is returned as is.
+func (r *Refactor) Apply(code string) (string, error) {
+	out, _, err := r.Rewrite(code)
+	return out, err
+}
+
+// Rewrite is like Apply, but also reports whether the code was changed
+func (r *Refactor) Rewrite(code string) (string, bool, error) {
+	if !r.mayMatch(code) {
+		return code, false, nil
 	}
+	return rewrite(code, r.conf, r.d)
+}
 
-	buf := &bytes.Buffer{}
-	if err := printer.Fprint(buf, token.NewFileSet(), golang.NodeToAST(res)); err != nil {
-		return "", err
+// mayMatch is a cheap check that reports false if the rule can't match the code, because some of the required
+// tokens are missing in it
+func (r *Refactor) mayMatch(code string) bool {
+	for _, tok := range r.tokens {
+		if !strings.Contains(code, tok) {
+			return false
+		}
 	}
+	return true
+}
 
-	fdata, err := format.Source(buf.Bytes())
+// transformArr applies the rule to the array of statements and reports whether it has changed
+func (r *Refactor) transformArr(arr nodes.Array) (nodes.Node, bool, error) {
+	st := transformer.NewState()
+	if ok, err := r.in.Check(st, arr); err != nil || !ok {
+		return arr, false, err
+	}
+	nn, err := r.out.Construct(st, nil)
 	if err != nil {
-		return "", err
+		return arr, false, err
 	}
-
-	return string(fdata), nil
+	return nn, true, nil
 }
 
 func trimPositions(n nodes.Node) (nodes.Node, error) {
@@ -104,38 +292,81 @@ func trimPositions(n nodes.Node) (nodes.Node, error) {
 	)).Do(n)
 }
 
-func nodeToOp(n nodes.Node) transformer.Op {
+// nodeToOp converts the snippet to an operation. Metavariables in values are used by template functions, they match
+// only nodes template functions can be applied to.
+func nodeToOp(n nodes.Node, rep *repeats, values map[string]struct{}) transformer.Op {
 	switch o := n.(type) {
 	case nil:
 		return transformer.Is(o)
 	case nodes.Value:
 		return transformer.Is(o)
 	case nodes.Object:
+		if isTemplateCall(o) {
+			// template calls are checked by validate
+			op, _ := templateOp(o)
+			return op
+		}
 		if uast.TypeOf(o) == "Ident" {
 			name := o["Name"]
 			str := name.(nodes.String)
-			if strings.HasPrefix(string(str), "X") {
+			if name, op, ok := splitOp(string(str)); ok {
+				// custom operations are checked by validate
+				fn, _ := lookupOp(op)
+				return fn(name)
+			} else if isFreshVar(string(str)) {
+				return opFresh(str)
+			} else if _, ok := values[string(str)]; ok {
+				return transformer.Check(templateArg{}, vartransform.Var(string(str)))
+			} else if isMetaVar(string(str)) {
 				return vartransform.Var(string(str))
 			}
 		}
 		// transformer.Fields is extended version of transformer.Obj
 		var res transformer.Fields
 		for k, v := range o {
-			// conditions to drop pos
+			// conditions to drop pos and the mark of top-level declarations
 			var field = transformer.Field{Name: k}
-			if k == uast.KeyPos {
+			if k == uast.KeyPos || k == topLevelKey {
 				field.Drop = true
 				field.Op = transformer.Any()
+			} else if name, ok := v.(nodes.String); ok && k == "Name" && uast.TypeOf(o) == "Ident" {
+				field.Op = opName(name)
+			} else if name, ok := bodyVar(v); ok {
+				field.Op = vartransform.Var(name)
+			} else if elem, tail, ok := repeatedIf(v); ok && k == "Else" {
+				field.Op = opRepeatIf{
+					name:   rep.name(elem),
+					shared: rep.shared,
+					elem:   nodeToOp(elem, rep, values),
+					tail:   nodeToOp(tail, rep, values),
+				}
 			} else {
-				field.Op = nodeToOp(v)
+				field.Op = nodeToOp(v, rep, values)
 			}
 			res = append(res, field)
 		}
 		return res
 	case nodes.Array:
-		var res []transformer.Op
+		var (
+			res    []transformer.Op
+			repeat *opRepeatArr
+		)
 		for _, node := range o {
-			res = append(res, nodeToOp(node))
+			if elem, ok := repeatedClause(node); ok {
+				repeat = &opRepeatArr{
+					name:   rep.name(elem),
+					shared: rep.shared,
+					prefix: res,
+					elem:   nodeToOp(elem, rep, values),
+				}
+				res = nil
+				continue
+			}
+			res = append(res, nodeToOp(node, rep, values))
+		}
+		if repeat != nil {
+			repeat.suffix = res
+			return *repeat
 		}
 		return transformer.Arr(res...)
 	default:
@@ -143,15 +374,225 @@ func nodeToOp(n nodes.Node) transformer.Op {
 	}
 }
 
-// TODO functions
-func parseNodeHack(snippet string) (nodes.Node, error) {
-	wrapped, err := golang.Parse(wrapInMain(snippet))
+func isMetaVar(name string) bool {
+	return strings.HasPrefix(name, "X")
+}
+
+// metaVars returns the number of occurrences of each metavariable in the snippet
+func metaVars(n nodes.Node) map[string]int {
+	vars := make(map[string]int)
+	var walk func(n nodes.Node)
+	walk = func(n nodes.Node) {
+		switch o := n.(type) {
+		case nodes.Object:
+			if uast.TypeOf(o) == "Ident" {
+				if name, ok := o["Name"].(nodes.String); ok && isMetaVar(string(name)) {
+					vars[varName(string(name))]++
+					return
+				}
+			}
+			for _, v := range o {
+				walk(v)
+			}
+		case nodes.Array:
+			for _, v := range o {
+				walk(v)
+			}
+		}
+	}
+	walk(n)
+	return vars
+}
+
+// bodyVar returns the name of the metavariable if the statement list consists of the $repeat(X1) marker only, such list
+// matches any statements
+func bodyVar(n nodes.Node) (string, bool) {
+	arr, ok := n.(nodes.Array)
+	if !ok || len(arr) != 1 {
+		return "", false
+	}
+	stmt, ok := arr[0].(nodes.Object)
+	if !ok || uast.TypeOf(stmt) != "ExprStmt" {
+		return "", false
+	}
+	args, ok := repeatArgs(stmt["X"])
+	if !ok || len(args) != 1 {
+		return "", false
+	}
+	x, ok := args[0].(nodes.Object)
+	if !ok || uast.TypeOf(x) != "Ident" {
+		return "", false
+	}
+	name, ok := x["Name"].(nodes.String)
+	if !ok || !isMetaVar(string(name)) || isFreshVar(string(name)) {
+		return "", false
+	} else if _, _, ok := splitOp(string(name)); ok {
+		return "", false
+	}
+	return string(name), true
+}
+
+// checkBodyVars checks that metavariables matching statement lists are not used as single nodes
+func checkBodyVars(in, out nodes.Node) error {
+	vars := metaVars(nodes.Array{in, out})
+	body := make(map[string]int)
+	var walk func(n nodes.Node)
+	walk = func(n nodes.Node) {
+		switch o := n.(type) {
+		case nodes.Object:
+			for _, v := range o {
+				if name, ok := bodyVar(v); ok {
+					body[name]++
+				} else {
+					walk(v)
+				}
+			}
+		case nodes.Array:
+			for _, v := range o {
+				walk(v)
+			}
+		}
+	}
+	walk(in)
+	walk(out)
+
+	var names []string
+	for name, cnt := range body {
+		if vars[name] != cnt {
+			names = append(names, name)
+		}
+	}
+	if len(names) != 0 {
+		sort.Strings(names)
+		return fmt.Errorf("metavariables are used both as statement lists and as single nodes: %s", strings.Join(names, ", "))
+	}
+	return nil
+}
+
+// requiredTokens returns identifiers (except metavariables) and literals of the snippet, longest first
+func requiredTokens(n nodes.Node) []string {
+	set := make(map[string]struct{})
+	// repeated branches may match nothing, so their tokens are not required
+	walkOutside(n, func(n nodes.Node) bool {
+		if _, ok := bodyVar(n); ok {
+			return false
+		}
+		obj, ok := n.(nodes.Object)
+		if !ok {
+			return true
+		}
+		switch uast.TypeOf(obj) {
+		case "Ident":
+			if name, ok := obj["Name"].(nodes.String); ok && !isMetaVar(string(name)) {
+				// the file refers to a declared package by any name, but always imports it by path
+				set[strings.TrimPrefix(string(name), qualifierPrefix)] = struct{}{}
+			}
+			return false
+		case "BasicLit":
+			if val, ok := obj["Value"].(nodes.String); ok {
+				set[string(val)] = struct{}{}
+			}
+			return false
+		}
+		return true
+	})
+
+	tokens := make([]string, 0, len(set))
+	for tok := range set {
+		tokens = append(tokens, tok)
+	}
+	// longer tokens are more selective
+	sort.Slice(tokens, func(i, j int) bool {
+		if len(tokens[i]) != len(tokens[j]) {
+			return len(tokens[i]) > len(tokens[j])
+		}
+		return tokens[i] < tokens[j]
+	})
+	return tokens
+}
+
+// isDeclSnippet reports whether the snippet consists of top-level declarations including functions or types
+func isDeclSnippet(snippet string) bool {
+	f, _, err := golang.ParseString(declTemplate + snippet)
 	if err != nil {
-		return nil, err
+		return false
+	}
+	for _, decl := range f.Decls {
+		switch decl := decl.(type) {
+		case *ast.FuncDecl:
+			return true
+		case *ast.GenDecl:
+			if decl.Tok == token.TYPE {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// parseNodeHack parses statements of the snippet, or declarations if decls is set, and converts them to an array of
+// nodes. Declarations are wrapped into declaration statements, so they are matched the same way as statements.
+// Qualifiers of the declared packages are replaced by import paths.
+func parseNodeHack(snippet string, imports map[string]string, decls bool) ([]ast.Stmt, *token.FileSet, nodes.Node, error) {
+	root, stmts, fs, err := parseSnippet(snippet, decls)
+	if err != nil {
+		return nil, nil, nil, err
 	}
 
-	list := wrapped.(nodes.Object)["Decls"].(nodes.Array)[0].(nodes.Object)["Body"].(nodes.Object)["List"].(nodes.Array)
-	return trimPositions(list)
+	if len(imports) != 0 {
+		qualifyNames(root, imports)
+	}
+	list, err := golang.ValueToNode(reflect.ValueOf(stmts), fs)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	// empty function body is converted to nil list
+	arr, _ := list.(nodes.Array)
+	n, err := trimPositions(arr)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return stmts, fs, n, nil
+}
+
+// parseSnippet parses the snippet and returns the root node and its statements. Snippets of case clauses are parsed
+// as the body of a switch or, if that fails, of a select statement.
+func parseSnippet(snippet string, decls bool) (ast.Node, []ast.Stmt, *token.FileSet, error) {
+	if decls {
+		f, fs, err := golang.ParseString(declTemplate + snippet)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		return f, wrapDecls(f.Decls), fs, nil
+	}
+	if !clauseSnippet.MatchString(snippet) {
+		f, fs, err := golang.ParseString(wrapInMain(snippet))
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		body := f.Decls[0].(*ast.FuncDecl).Body
+		return body, body.List, fs, nil
+	}
+
+	var firstErr error
+	for _, tmpl := range clauseTemplates {
+		f, fs, err := golang.ParseString(wrapInMain(fmt.Sprintf(tmpl, snippet)))
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		var body *ast.BlockStmt
+		switch stmt := f.Decls[0].(*ast.FuncDecl).Body.List[0].(type) {
+		case *ast.SwitchStmt:
+			body = stmt.Body
+		case *ast.SelectStmt:
+			body = stmt.Body
+		}
+		return body, body.List, fs, nil
+	}
+	return nil, nil, nil, firstErr
 }
 
 // TODO gofmt
@@ -1,15 +1,37 @@
 package gofactor_test
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"go/ast"
 	"go/format"
+	"go/token"
+	"go/types"
 	"io/ioutil"
+	"os"
 	"path/filepath"
+	"runtime"
+	"strings"
 	"testing"
 
+	"github.com/bblfsh/sdk/v3/uast"
+	"github.com/bblfsh/sdk/v3/uast/nodes"
+	"github.com/bblfsh/sdk/v3/uast/transformer"
 	"github.com/lwsanty/gofactor"
+	"github.com/lwsanty/gofactor/golang"
+	"github.com/lwsanty/gofactor/transform/vartransform"
 	"github.com/stretchr/testify/require"
 )
 
+// fixtureOptions holds refactor options for fixtures that need them
+var fixtureOptions = map[string][]gofactor.Option{
+	"repeated-first":  {gofactor.FirstMatch()},
+	"repeated-max":    {gofactor.MaxMatches(2)},
+	"fixpoint-inline": {gofactor.Fixpoint(10)},
+	"imports-alias":   {gofactor.Imports(map[string]string{"ioutil": "io/ioutil"})},
+}
+
 func TestAll(t *testing.T) {
 	dirs, err := filepath.Glob("fixtures/*")
 	require.NoError(t, err)
@@ -31,18 +53,836 @@ func testCase(t *testing.T, d string) {
 		require.NoError(t, err)
 		return string(fdata)
 	}
+	// snippets of case clauses can't be formatted on their own
+	getSnippet := func(name string) string {
+		data, err := ioutil.ReadFile(filepath.Join(d, name))
+		require.NoError(t, err)
+
+		if fdata, err := format.Source(data); err == nil {
+			return string(fdata)
+		}
+		return string(data)
+	}
 
 	var (
-		after    = getFileContent("after")
-		before   = getFileContent("before")
+		after    = getSnippet("after")
+		before   = getSnippet("before")
 		example  = getFileContent("example.go")
 		expected = getFileContent("expected")
 	)
 
-	refactor, err := gofactor.NewRefactor(before, after)
+	for _, e := range engines {
+		e := e
+		t.Run(e.name, func(t *testing.T) {
+			opts := append([]gofactor.Option{gofactor.WithEngine(e.engine)}, fixtureOptions[filepath.Base(d)]...)
+			refactor, err := gofactor.NewRefactor(before, after, opts...)
+			require.NoError(t, err)
+
+			actual, err := refactor.Apply(example)
+			require.NoError(t, err)
+			require.Equal(t, expected, actual)
+		})
+	}
+}
+
+func TestValidation(t *testing.T) {
+	cases := []struct {
+		name     string
+		before   string
+		after    string
+		err      bool
+		warnings int
+	}{
+		{name: "valid", before: "X1 = X2", after: "X2 = X1"},
+		{name: "empty before", before: "", after: "i = 1", err: true},
+		{name: "empty after", before: "i = 1", after: ""},
+		{name: "unbound", before: "X1 = 1", after: "X1 = X2", err: true},
+		{name: "bound once", before: "X1 = X2", after: "X1 = 1", warnings: 1},
+		{name: "no-op", before: "X1 = X1 + 1", after: "X1 = X1 + 1", warnings: 1},
+		{name: "body as node", before: "if X1 {\n\t$repeat(X2)\n}", after: "X2", err: true},
+		{name: "repeated top-level clause", before: "case $repeat(X1):\n\treturn", after: "case $repeat(X1):\n\treturn nil", err: true},
+		{name: "repeated without own vars", before: "if X1 {\n} else if $repeat(X1) {\n}", after: "if X1 {\n}", err: true},
+		{name: "repeated var outside", before: "if X1 {\n} else if $repeat(X2) {\n}", after: "if X2 {\n}", err: true},
+		{name: "fresh in before", before: "X_tmp = X1", after: "X1", err: true},
+		{name: "fresh without name", before: "X1", after: "X_ := X1", err: true},
+		{name: "template in before", before: "X1 = $toUpper(X2)", after: "X1 = X2", err: true},
+		{name: "template arguments", before: "X1 = X2", after: "X1 = $trimPrefix(X2)", err: true},
+		{name: "template regexp", before: "X1 = X2", after: "X1 = $replace(X2, \"(\", \"\")", err: true},
+		{name: "unknown template", before: "X1 = X2", after: "X1 = $upper(X2)", err: true},
+		{name: "plain call", before: "X1 = X2", after: "X1 = quote(X2)"},
+		{name: "template method", before: "X1.X2()", after: "X1.$trimPrefix(X2, \"Get\")()", err: true},
+		{name: "template value", before: "X1 = X2", after: "X1 = $toUpper", err: true},
+		{name: "template constant", before: "X1 = X2", after: "X1 = $toUpper(\"a\")", err: true},
+		{name: "repeated vars mixed", before: "switch {\ncase $repeat(X1):\n\tX2\n}\nswitch {\ncase $repeat(X3):\n\tX4\n}", after: "switch {\ncase $repeat(X1):\n\tX4\n}", err: true},
+	}
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			refactor, err := gofactor.NewRefactor(c.before, c.after)
+			if c.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Len(t, refactor.Warnings(), c.warnings)
+		})
+	}
+}
+
+func TestInverse(t *testing.T) {
+	refactor, err := gofactor.NewRefactor("X1 = X2 + 1", "X1 = X2 - 1")
+	require.NoError(t, err)
+
+	inv, err := refactor.Inverse()
+	require.NoError(t, err)
+
+	const code = "package main\n\nfunc main() {\n\ta = b + 1\n}\n"
+	out, err := refactor.Apply(code)
+	require.NoError(t, err)
+
+	out, err = inv.Apply(out)
+	require.NoError(t, err)
+	require.Equal(t, code, out)
+
+	// X2 is dropped by the rule, so it can't be restored
+	refactor, err = gofactor.NewRefactor("X1 = X2", "X1 = 1")
+	require.NoError(t, err)
+	_, err = refactor.Inverse()
+	require.Error(t, err)
+}
+
+// engines lists all rewrite engines, tests that don't depend on the engine are run for each of them
+var engines = []struct {
+	name   string
+	engine gofactor.Engine
+}{
+	{name: "uast", engine: gofactor.EngineUAST},
+	{name: "ast", engine: gofactor.EngineAST},
+}
+
+func TestFixpoint(t *testing.T) {
+	const code = "package main\n\nfunc main() {\n\ta = b + c\n}\n"
+
+	for _, e := range engines {
+		e := e
+		t.Run(e.name, func(t *testing.T) {
+			engine := gofactor.WithEngine(e.engine)
+
+			swap, err := gofactor.NewRefactor("X1 = X2 + X3", "X1 = X3 + X2", gofactor.Fixpoint(0), engine)
+			require.NoError(t, err)
+			_, err = swap.Apply(code)
+			require.Error(t, err)
+
+			inc, err := gofactor.NewRefactor("X1 = X2 + 1", "X1 = X2 + 2")
+			require.NoError(t, err)
+			dec, err := gofactor.NewRefactor("X1 = X2 + 2", "X1 = X2 + 1")
+			require.NoError(t, err)
+			_, err = gofactor.NewRuleSet([]*gofactor.Refactor{inc, dec}, gofactor.Fixpoint(0), engine).Apply("package main\n\nfunc main() {\n\ta = b + 1\n}\n")
+			require.Error(t, err)
+
+			out, changed, err := gofactor.NewRuleSet([]*gofactor.Refactor{dec, inc}, gofactor.Fixpoint(0), engine).Rewrite(code)
+			require.NoError(t, err)
+			require.False(t, changed)
+			require.Equal(t, code, out)
+		})
+	}
+}
+
+func TestRuleSetOrder(t *testing.T) {
+	const code = "package main\n\nfunc main() {\n\ti++\n\ti++\n\tj := 1\n}\n"
+
+	double, err := gofactor.NewRefactor("X1++\nX1++", "X1 += 2")
+	require.NoError(t, err)
+	single, err := gofactor.NewRefactor("X1++", "X1 += 1")
+	require.NoError(t, err)
+	define, err := gofactor.NewRefactor("X1 := X2", "var X1 = X2")
+	require.NoError(t, err)
+
+	for _, e := range engines {
+		e := e
+		t.Run(e.name, func(t *testing.T) {
+			engine := gofactor.WithEngine(e.engine)
+
+			out, err := gofactor.NewRuleSet([]*gofactor.Refactor{double, single, define}, engine).Apply(code)
+			require.NoError(t, err)
+			require.Equal(t, "package main\n\nfunc main() {\n\ti += 2\n\tvar j = 1\n}\n", out)
+
+			out, err = gofactor.NewRuleSet([]*gofactor.Refactor{single, double, define}, engine).Apply(code)
+			require.NoError(t, err)
+			require.Equal(t, "package main\n\nfunc main() {\n\ti += 1\n\ti += 1\n\tvar j = 1\n}\n", out)
+		})
+	}
+}
+
+func TestRuleSetChain(t *testing.T) {
+	const code = "package main\n\nfunc main() {\n\ti++\n}\n"
+
+	expand, err := gofactor.NewRefactor("X1++", "X1 = X1 + 1")
+	require.NoError(t, err)
+	shorten, err := gofactor.NewRefactor("X1 = X1 + 1", "X1 += 1")
+	require.NoError(t, err)
+
+	for _, e := range engines {
+		e := e
+		t.Run(e.name, func(t *testing.T) {
+			engine := gofactor.WithEngine(e.engine)
+
+			// the statement produced by the first rule is matched by the second one
+			out, err := gofactor.NewRuleSet([]*gofactor.Refactor{expand, shorten}, engine).Apply(code)
+			require.NoError(t, err)
+			require.Equal(t, "package main\n\nfunc main() {\n\ti += 1\n}\n", out)
+
+			out, err = gofactor.NewRuleSet([]*gofactor.Refactor{shorten, expand}, engine).Apply(code)
+			require.NoError(t, err)
+			require.Equal(t, "package main\n\nfunc main() {\n\ti = i + 1\n}\n", out)
+		})
+	}
+}
+
+func TestTypeErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gofactor")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "p.go")
+	const code = "package p\n\nfunc f() int {\n\ta := 1\n\treturn a\n}\n"
+	require.NoError(t, ioutil.WriteFile(path, []byte(code), 0644))
+
+	refactor, err := gofactor.NewRefactor("X1 := X2", "X1 := X2\nX1 := X2")
+	require.NoError(t, err)
+	out, err := refactor.Apply(code)
+	require.NoError(t, err)
+
+	before, err := gofactor.TypeErrors(dir, nil)
+	require.NoError(t, err)
+	require.Empty(t, before)
+
+	after, err := gofactor.TypeErrors(dir, map[string][]byte{path: []byte(out)})
+	require.NoError(t, err)
+	require.Len(t, gofactor.NewTypeErrors(before[path], after[path], nil), 1)
+}
+
+func TestNewTypeErrors(t *testing.T) {
+	fs := token.NewFileSet()
+	file := fs.AddFile("p.go", -1, 100)
+	for off := 10; off < 100; off += 10 {
+		file.AddLine(off)
+	}
+	at := func(line int) types.Error {
+		return types.Error{Fset: fs, Pos: file.LineStart(line), Msg: "cannot use x"}
+	}
+	// lines 4 and 5 are rewritten, other lines are kept
+	lines := func(line int) (int, bool) {
+		return line, line != 4 && line != 5
+	}
+
+	// the error of the rewritten line is gone, but the same one appeared at a kept line
+	require.Len(t, gofactor.NewTypeErrors([]types.Error{at(4)}, []types.Error{at(7)}, lines), 1)
+	// errors at rewritten lines are compared by message
+	require.Empty(t, gofactor.NewTypeErrors([]types.Error{at(4)}, []types.Error{at(5)}, lines))
+	require.Len(t, gofactor.NewTypeErrors([]types.Error{at(4)}, []types.Error{at(4), at(5)}, lines), 1)
+	// and errors at kept lines by message and line
+	require.Empty(t, gofactor.NewTypeErrors([]types.Error{at(2), at(7)}, []types.Error{at(7), at(2)}, lines))
+	require.Len(t, gofactor.NewTypeErrors([]types.Error{at(2)}, []types.Error{at(7)}, nil), 1)
+}
+
+func TestIsGenerated(t *testing.T) {
+	require.True(t, gofactor.IsGenerated([]byte("// Code generated by stringer. DO NOT EDIT.\n\npackage p\n")))
+	require.True(t, gofactor.IsGenerated([]byte("// +build linux\n\n// Code generated by hand. DO NOT EDIT.\npackage p\n")))
+	require.False(t, gofactor.IsGenerated([]byte("package p\n\n// Code generated by stringer. DO NOT EDIT.\n")))
+	require.False(t, gofactor.IsGenerated([]byte("// Code generated by stringer.\npackage p\n")))
+}
+
+func TestMatchBuild(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gofactor")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "p.go")
+	require.NoError(t, ioutil.WriteFile(path, []byte("//go:build mytag\n// +build mytag\n\npackage p\n"), 0644))
+
+	ok, err := gofactor.MatchBuild(gofactor.BuildContext(), path)
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	ok, err = gofactor.MatchBuild(gofactor.BuildContext("other", "mytag"), path)
+	require.NoError(t, err)
+	require.True(t, ok)
+}
+
+func TestPrefilter(t *testing.T) {
+	refactor, err := gofactor.NewRefactor("X1 := ioutil.ReadAll(X2)", "X1 := io.ReadAll(X2)")
+	require.NoError(t, err)
+
+	// not a valid Go code, but it is not parsed, because it doesn't contain "ioutil"
+	const code = "package main\n\nfunc main() {\n"
+	out, changed, err := refactor.Rewrite(code)
+	require.NoError(t, err)
+	require.False(t, changed)
+	require.Equal(t, code, out)
+
+	_, _, err = refactor.Rewrite(code + "\tioutil.ReadAll(r)\n")
+	require.Error(t, err)
+}
+
+// largeCode generates a file with n functions with the given body
+func largeCode(n int, body string) string {
+	buf := &bytes.Buffer{}
+	buf.WriteString("package main\n\nimport \"fmt\"\n")
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(buf, "\nfunc f%d(i int) {\n%s\n}\n", i, body)
+	}
+	return buf.String()
+}
+
+func BenchmarkPrefilter(b *testing.B) {
+	refactor, err := gofactor.NewRefactor("X1 := ioutil.ReadAll(X2)", "X1 := io.ReadAll(X2)")
+	require.NoError(b, err)
+
+	const body = "\tif i%2 == 0 {\n\t\ti = 5\n\t}\n\tfmt.Println(i)"
+	for _, c := range []struct {
+		name string
+		code string
+	}{
+		// the file doesn't contain "ioutil" and "ReadAll", so it's skipped without parsing
+		{name: "skipped", code: largeCode(200, body)},
+		// the file contains all tokens in a comment, thus it's parsed, but doesn't match
+		{name: "parsed", code: largeCode(200, body) + "\n// ioutil.ReadAll\n"},
+	} {
+		c := c
+		b.Run(c.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				_, changed, err := refactor.Rewrite(c.code)
+				if err != nil {
+					b.Fatal(err)
+				} else if changed {
+					b.Fatal("unexpected change")
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkEngines(b *testing.B) {
+	for _, c := range []struct {
+		name string
+		body string
+	}{
+		{name: "match", body: "\tif i%2 == 0 {\n\t\ti = 5\n\t}\n\tfmt.Println(i)"},
+		{name: "nomatch", body: "\tif i%2 == 0 {\n\t\ti = 6\n\t}\n\tfmt.Println(i)"},
+	} {
+		code := largeCode(200, c.body)
+		for _, e := range engines {
+			refactor, err := gofactor.NewRefactor("if X1%2 == 0 {\n\tX1 = 5\n}", "if X1%2 == 1 {\n\tX1 = 1\n}", gofactor.WithEngine(e.engine))
+			require.NoError(b, err)
+			b.Run(c.name+"/"+e.name, func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					if _, err := refactor.Apply(code); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestRuleSetConflicts(t *testing.T) {
+	const code = "package main\n\nfunc main() {\n\ti++\n\ti++\n\tj++\n}\n"
+
+	double, err := gofactor.NewRefactor("X1++\nX1++", "X1 += 2", gofactor.Named("double"))
+	require.NoError(t, err)
+	single, err := gofactor.NewRefactor("j++", "j += 1", gofactor.Named("single"), gofactor.Priority(1))
+	require.NoError(t, err)
+	inc, err := gofactor.NewRefactor("X1++", "X1 += 1", gofactor.Named("any"))
+	require.NoError(t, err)
+
+	set := gofactor.NewRuleSet([]*gofactor.Refactor{double, single, inc})
+	require.Equal(t, []*gofactor.Refactor{single, double, inc}, set.Rules())
+
+	conflicts, err := set.Conflicts(code)
+	require.NoError(t, err)
+	// any matches both i++ statements, each of them overlaps with double
+	require.Len(t, conflicts, 3)
+	require.Equal(t, [2]string{"double", "any"}, conflicts[1].Rules)
+	require.Equal(t, 4, conflicts[1].Pos[0].Line)
+	require.Equal(t, 5, conflicts[1].Pos[1].Line)
+	require.Equal(t, [2]string{"single", "any"}, conflicts[2].Rules)
+	require.Equal(t, 6, conflicts[2].Pos[0].Line)
+
+	problems, err := set.Lint()
+	require.NoError(t, err)
+	// any matches a part of double only, so it doesn't subsume it
+	require.Equal(t, []string{
+		"rule any subsumes rule single: code matched by single is matched by any as well",
+	}, problems)
+
+	nested, err := gofactor.NewRefactor("if X1 {\n\tX2++\n}", "if X1 {\n\tX2 += 1\n}", gofactor.Named("nested"))
+	require.NoError(t, err)
+	problems, err = gofactor.NewRuleSet([]*gofactor.Refactor{inc, nested}).Lint()
+	require.NoError(t, err)
+	require.Empty(t, problems)
+}
+
+func TestImports(t *testing.T) {
+	cases := []struct {
+		name    string
+		before  string
+		after   string
+		imports map[string]string
+		code    string
+		exp     string
+	}{
+		{
+			name:   "add to empty",
+			before: "X1 := X2",
+			after:  "X1 := strings.TrimSpace(X2)",
+			code:   "package main\n\nfunc main() {\n\ts := \"a\"\n}\n",
+			exp:    "package main\n\nimport \"strings\"\n\nfunc main() {\n\ts := strings.TrimSpace(\"a\")\n}\n",
+		},
+		{
+			name:    "declared with alias",
+			before:  "X1 := X2",
+			after:   "X1 := pkgerrors.New(X2)",
+			imports: map[string]string{"pkgerrors": "github.com/pkg/errors"},
+			code:    "package main\n\nimport (\n\t\"fmt\"\n\n\t\"example.com/b\"\n)\n\nfunc main() {\n\te := \"a\"\n\tfmt.Println(b.X, e)\n}\n",
+			exp:     "package main\n\nimport (\n\t\"fmt\"\n\n\t\"example.com/b\"\n\tpkgerrors \"github.com/pkg/errors\"\n)\n\nfunc main() {\n\te := pkgerrors.New(\"a\")\n\tfmt.Println(b.X, e)\n}\n",
+		},
+		{
+			name:   "remove last",
+			before: "X1 := strings.TrimSpace(X2)",
+			after:  "X1 := X2",
+			code:   "package main\n\nimport (\n\t\"fmt\"\n\t\"strings\"\n\t_ \"unsafe\"\n)\n\nfunc main() {\n\ts := strings.TrimSpace(\"a\")\n\tfmt.Println(s)\n}\n",
+			exp:    "package main\n\nimport (\n\t\"fmt\"\n\t_ \"unsafe\"\n)\n\nfunc main() {\n\ts := \"a\"\n\tfmt.Println(s)\n}\n",
+		},
+		{
+			name:   "local variable",
+			before: "X1 := X2",
+			after:  "X1 := strings.X2",
+			code:   "package main\n\nfunc main() {\n\tvar strings int\n\ts := A\n}\n",
+			exp:    "package main\n\nfunc main() {\n\tvar strings int\n\ts := strings.A\n}\n",
+		},
+	}
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			for _, e := range engines {
+				r, err := gofactor.NewRefactor(c.before, c.after, gofactor.Imports(c.imports), gofactor.WithEngine(e.engine))
+				require.NoError(t, err)
+				out, err := r.Apply(c.code)
+				require.NoError(t, err, e.name)
+				require.Equal(t, c.exp, out, e.name)
+			}
+		})
+	}
+}
+
+func TestImportHeader(t *testing.T) {
+	const (
+		before = "import \"io/ioutil\"\n\nX1, X2 := ioutil.ReadAll(X3)"
+		after  = "import \"io\"\n\nX1, X2 := io.ReadAll(X3)"
+		code   = "package main\n\nimport (\n\tstdio \"io\"\n\tiu \"io/ioutil\"\n)\n\nvar r stdio.Reader\n\nfunc main() {\n\tdata, err := iu.ReadAll(r)\n\t_, _ = data, err\n}\n"
+		exp    = "package main\n\nimport stdio \"io\"\n\nvar r stdio.Reader\n\nfunc main() {\n\tdata, err := stdio.ReadAll(r)\n\t_, _ = data, err\n}\n"
+	)
+	for _, e := range engines {
+		r, err := gofactor.NewRefactor(before, after, gofactor.WithEngine(e.engine))
+		require.NoError(t, err)
+		out, err := r.Apply(code)
+		require.NoError(t, err, e.name)
+		require.Equal(t, exp, out, e.name)
+
+		inv, err := r.Inverse()
+		require.NoError(t, err)
+		out, changed, err := inv.Rewrite(code)
+		require.NoError(t, err, e.name)
+		require.False(t, changed, e.name)
+	}
+
+	_, err := gofactor.NewRefactor("import \"errors\"\n\nerrors.New(X1)", "import errors \"github.com/pkg/errors\"\n\nerrors.New(X1)")
+	require.Error(t, err)
+}
+
+func TestRoundTripStdlib(t *testing.T) {
+	if testing.Short() {
+		t.Skip("round trip of the standard library is slow")
+	}
+	// files of the standard library by directory, testdata is skipped like in verify-roundtrip
+	dirs := make(map[string][]string)
+	err := filepath.Walk(filepath.Join(runtime.GOROOT(), "src"), func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() && fi.Name() == "testdata" {
+			return filepath.SkipDir
+		} else if !fi.IsDir() && strings.HasSuffix(path, ".go") {
+			dirs[filepath.Dir(path)] = append(dirs[filepath.Dir(path)], path)
+		}
+		return nil
+	})
 	require.NoError(t, err)
+	require.NotEmpty(t, dirs)
+
+	for dir, files := range dirs {
+		files := files
+		t.Run(dir, func(t *testing.T) {
+			t.Parallel()
+			for _, path := range files {
+				data, err := ioutil.ReadFile(path)
+				require.NoError(t, err)
+				want, got, err := golang.RoundTrip(string(data))
+				require.NoError(t, err, path)
+				require.Equal(t, want, got, path)
+			}
+		})
+	}
+}
 
-	actual, err := refactor.Apply(example)
+func TestTolerant(t *testing.T) {
+	const (
+		code = "package main\n\n// a is broken\nfunc a() {\n\ti++\n\tif {\n}\n\nfunc b() {\n\ti++\n}\n"
+		exp  = "package main\n\n// a is broken\nfunc a() {\n\ti++\n\tif {\n}\n\nfunc b() {\n\ti += 1\n}\n"
+	)
+	for _, e := range engines {
+		r, err := gofactor.NewRefactor("X1++", "X1 += 1", gofactor.WithEngine(e.engine))
+		require.NoError(t, err)
+		_, err = r.Apply(code)
+		require.Error(t, err, e.name)
+
+		r, err = gofactor.NewRefactor("X1++", "X1 += 1", gofactor.WithEngine(e.engine), gofactor.Tolerant())
+		require.NoError(t, err)
+		out, changed, err := r.Rewrite(code)
+		var serr *gofactor.SyntaxError
+		require.True(t, errors.As(err, &serr), e.name)
+		require.Equal(t, 6, serr.Errors[0].Pos.Line)
+		require.True(t, changed)
+		require.Equal(t, exp, out, e.name)
+
+		out, changed, err = r.Rewrite("package main\n\nfunc a() {\n\ti++\n}\n")
+		require.NoError(t, err)
+		require.True(t, changed)
+		require.Equal(t, "package main\n\nfunc a() {\n\ti += 1\n}\n", out)
+	}
+	// a raw string with lines starting with keywords doesn't split the declaration
+	const raw = "package main\n\nfunc s() string {\n\treturn `\nfunc x\nvar y\n`\n}\n\nfunc a() {\n\tif {\n}\n\nfunc b() {\n\ti++\n}\n"
+	r, err := gofactor.NewRefactor("X1++", "X1 += 1", gofactor.Tolerant())
+	require.NoError(t, err)
+	out, changed, err := r.Rewrite(raw)
+	var serr *gofactor.SyntaxError
+	require.True(t, errors.As(err, &serr))
+	for _, e := range serr.Errors {
+		// all errors are in func a
+		require.True(t, e.Pos.Line >= 10 && e.Pos.Line <= 12, e.Error())
+	}
+	require.True(t, changed)
+	require.Equal(t, strings.Replace(raw, "i++", "i += 1", 1), out)
+
+	// imports used only by broken declarations are kept
+	const imports = "package main\n\nimport \"strings\"\n\nfunc a() {\n\tx := strings.TrimSpace(y)\n\tif {\n}\n\nfunc b() {\n\tx = strings.TrimSpace(y)\n}\n"
+	r, err = gofactor.NewRefactor("X1 = strings.TrimSpace(X2)", "X1 = trim(X2)", gofactor.Tolerant())
+	require.NoError(t, err)
+	out, changed, err = r.Rewrite(imports)
+	require.True(t, errors.As(err, &serr))
+	require.True(t, changed)
+	require.Equal(t, strings.Replace(imports, "x = strings.TrimSpace(y)", "x = trim(y)", 1), out)
+}
+
+func TestTailRec(t *testing.T) {
+	dirs, err := filepath.Glob("testdata/tailrec/*")
 	require.NoError(t, err)
-	require.Equal(t, expected, actual)
+	require.NotEmpty(t, dirs)
+
+	for _, d := range dirs {
+		before, err := ioutil.ReadFile(filepath.Join(d, "before.go"))
+		require.NoError(t, err)
+		after, err := ioutil.ReadFile(filepath.Join(d, "after.go"))
+		require.NoError(t, err)
+
+		out, changed, skips, err := gofactor.TailRec(string(before))
+		require.NoError(t, err, d)
+		require.True(t, changed, d)
+		require.Empty(t, skips, d)
+		require.Equal(t, string(after), out, d)
+
+		_, changed, skips, err = gofactor.TailRec(out)
+		require.NoError(t, err, d)
+		require.False(t, changed, d)
+		require.Empty(t, skips, d)
+	}
+}
+
+func TestTailRecUnsafe(t *testing.T) {
+	cases := []struct {
+		name   string
+		fn     string
+		reason string
+	}{
+		{name: "defer", fn: "func f(n int) {\n\tdefer println(n)\n\tif n > 0 {\n\t\tf(n - 1)\n\t}\n}", reason: "defer statement"},
+		{name: "closure", fn: "func f(n int, fns []func() int) []func() int {\n\tif n == 0 {\n\t\treturn fns\n\t}\n\treturn f(n-1, append(fns, func() int { return n }))\n}", reason: "closure captures parameter n"},
+		{name: "address", fn: "func f(n int, ps []*int) []*int {\n\tif n == 0 {\n\t\treturn ps\n\t}\n\treturn f(n-1, append(ps, &n))\n}", reason: "address of parameter n is taken"},
+		{name: "named result", fn: "func f(n int) (res int) {\n\tif n == 0 {\n\t\treturn\n\t}\n\tres = n\n\treturn f(n - 1)\n}", reason: "named result res is modified"},
+		{name: "redeclared", fn: "func f(n int) int {\n\tif n, ok := g(n); ok {\n\t\treturn f(n)\n\t}\n\treturn n\n}", reason: "parameter n is redeclared"},
+		{name: "not tail", fn: "func f(n int) int {\n\tif n == 0 {\n\t\treturn 1\n\t}\n\treturn n * f(n-1)\n}", reason: "recursive call is not in tail position"},
+		{name: "generic", fn: "func f[T any](n int, v T) T {\n\tif n == 0 {\n\t\treturn v\n\t}\n\treturn f(n-1, v)\n}", reason: "type parameters"},
+	}
+	for _, c := range cases {
+		code := "package main\n\n" + c.fn + "\n"
+		out, changed, skips, err := gofactor.TailRec(code)
+		require.NoError(t, err, c.name)
+		require.False(t, changed, c.name)
+		require.Equal(t, code, out, c.name)
+		require.Len(t, skips, 1, c.name)
+		require.Equal(t, "f", skips[0].Func, c.name)
+		require.Equal(t, c.reason, skips[0].Reason, c.name)
+	}
+}
+
+func TestScopeAware(t *testing.T) {
+	cases := []struct {
+		name          string
+		before, after string
+		code          string
+		// exp is the result in scope-aware mode, the code is rewritten by default
+		exp string
+	}{
+		{
+			name:   "same variable",
+			before: "X1 = X1 + 1",
+			after:  "X1++",
+			code:   "package main\n\nfunc main() {\n\tn := 0\n\tn = n + 1\n}\n",
+			exp:    "package main\n\nfunc main() {\n\tn := 0\n\tn++\n}\n",
+		},
+		{
+			name:   "field and variable",
+			before: "X1.X2 = X2",
+			after:  "X1.set(X2)",
+			code:   "package main\n\nfunc (c *conf) init(name string) {\n\tc.name = name\n}\n",
+			exp:    "package main\n\nfunc (c *conf) init(name string) {\n\tc.name = name\n}\n",
+		},
+		{
+			name:   "shadowed variable",
+			before: "for _, X1 := range X2 {\n\tX3 += X1\n}\nfor _, X1 := range X4 {\n\tX3 += X1\n}",
+			after:  "for _, X1 := range append(X2, X4...) {\n\tX3 += X1\n}",
+			code:   "package main\n\nfunc main() {\n\tfor _, v := range a {\n\t\tsum += v\n\t}\n\tfor _, v := range b {\n\t\tsum += v\n\t}\n}\n",
+			exp:    "package main\n\nfunc main() {\n\tfor _, v := range a {\n\t\tsum += v\n\t}\n\tfor _, v := range b {\n\t\tsum += v\n\t}\n}\n",
+		},
+	}
+	for _, c := range cases {
+		for _, e := range engines {
+			r, err := gofactor.NewRefactor(c.before, c.after, gofactor.WithEngine(e.engine))
+			require.NoError(t, err)
+			_, changed, err := r.Rewrite(c.code)
+			require.NoError(t, err, c.name)
+			require.True(t, changed, c.name)
+
+			r, err = gofactor.NewRefactor(c.before, c.after, gofactor.WithEngine(e.engine), gofactor.ScopeAware())
+			require.NoError(t, err)
+			out, err := r.Apply(c.code)
+			require.NoError(t, err, c.name)
+			require.Equal(t, c.exp, out, c.name+" "+e.name)
+		}
+	}
+}
+
+func TestFresh(t *testing.T) {
+	const (
+		before = "X1(X2(X3))"
+		after  = "X_tmp := X2(X3)\nX1(X_tmp)"
+		code   = "package main\n\nfunc main() {\n\ttmp := 1\n\tprintln(f(g(tmp)))\n\tprintln(f(g(2)))\n}\n"
+		exp    = "package main\n\nfunc main() {\n\ttmp := 1\n\ttmp1 := f(g(tmp))\n\tprintln(tmp1)\n\ttmp2 := f(g(2))\n\tprintln(tmp2)\n}\n"
+	)
+	for _, e := range engines {
+		r, err := gofactor.NewRefactor(before, after, gofactor.WithEngine(e.engine))
+		require.NoError(t, err)
+		require.Empty(t, r.Warnings())
+		out, err := r.Apply(code)
+		require.NoError(t, err, e.name)
+		require.Equal(t, exp, out, e.name)
+	}
+}
+
+func TestBodyVars(t *testing.T) {
+	const code = "package main\n\nfunc main() {\n\tif a {\n\t\tf()\n\t}\n\tif b {\n\t\tg()\n\t\th()\n\t}\n}\n"
+	cases := []struct {
+		name          string
+		before, after string
+		exp           string
+	}{
+		{
+			name:   "single statement",
+			before: "if X1 {\n\tX2\n}",
+			after:  "if !X1 {\n} else {\n\tX2\n}",
+			exp:    "package main\n\nfunc main() {\n\tif !a {\n\t} else {\n\t\tf()\n\t}\n\tif b {\n\t\tg()\n\t\th()\n\t}\n}\n",
+		},
+		{
+			name:   "statement list",
+			before: "if X1 {\n\t$repeat(X2)\n}",
+			after:  "if !X1 {\n} else {\n\t$repeat(X2)\n}",
+			exp:    "package main\n\nfunc main() {\n\tif !a {\n\t} else {\n\t\tf()\n\t}\n\tif !b {\n\t} else {\n\t\tg()\n\t\th()\n\t}\n}\n",
+		},
+	}
+	for _, c := range cases {
+		for _, e := range engines {
+			r, err := gofactor.NewRefactor(c.before, c.after, gofactor.WithEngine(e.engine))
+			require.NoError(t, err, c.name)
+			out, err := r.Apply(code)
+			require.NoError(t, err, c.name)
+			require.Equal(t, c.exp, out, c.name+" "+e.name)
+		}
+	}
+}
+
+func TestRepeatFunction(t *testing.T) {
+	// without $ repeat is an ordinary function of the code
+	const (
+		code = "package main\n\nfunc main() {\n\tif a {\n\t\trepeat(f)\n\t}\n\tif b {\n\t\trepeat(g)\n\t\th()\n\t}\n}\n"
+		exp  = "package main\n\nfunc main() {\n\tif a {\n\t\tagain(f)\n\t}\n\tif b {\n\t\trepeat(g)\n\t\th()\n\t}\n}\n"
+	)
+	for _, e := range engines {
+		r, err := gofactor.NewRefactor("if X1 {\n\trepeat(X2)\n}", "if X1 {\n\tagain(X2)\n}", gofactor.WithEngine(e.engine))
+		require.NoError(t, err, e.name)
+		out, err := r.Apply(code)
+		require.NoError(t, err, e.name)
+		require.Equal(t, exp, out, e.name)
+	}
+}
+
+func TestTemplates(t *testing.T) {
+	cases := []struct {
+		name          string
+		before, after string
+		code, exp     string
+	}{
+		{
+			name:   "getter",
+			before: "X1()",
+			after:  "$trimPrefix(X1, \"Get\")()",
+			code:   "s.GetName()",
+			exp:    "s.Name()",
+		},
+		{
+			name:   "case conversion",
+			before: "X1 := X2",
+			after:  "$toCamel(X1) := $toSnake(X2)",
+			code:   "http_server := newHTTPServer",
+			exp:    "HttpServer := new_http_server",
+		},
+		{
+			name:   "string literal",
+			before: "X1 := X2",
+			after:  "X1 := $toLowerCamel(X2)",
+			code:   "key := \"HTTPServer_name\"",
+			exp:    "key := \"httpServerName\"",
+		},
+		{
+			name:   "quote",
+			before: "X1.X2 = X3",
+			after:  "X1.Set($quote(X2), X3)",
+			code:   "conf.Name = name",
+			exp:    "conf.Set(\"Name\", name)",
+		},
+		{
+			name:   "concat and replace",
+			before: "X1(X2)",
+			after:  "$concat(X1, \"_\", $replace(X2, \"[0-9]+$\", \"N\"))()",
+			code:   "run(test12)",
+			exp:    "run_testN()",
+		},
+		{
+			name:   "other bindings",
+			before: "X1 := X2",
+			after:  "X1 := $toUpper(X2)",
+			code:   "b := 1\n\ta := x",
+			exp:    "b := 1\n\ta := X",
+		},
+		{
+			name:   "plain call",
+			before: "X1(X2)",
+			after:  "X1(quote(X2))",
+			code:   "run(x)",
+			exp:    "run(quote(x))",
+		},
+	}
+	for _, c := range cases {
+		for _, e := range engines {
+			r, err := gofactor.NewRefactor(c.before, c.after, gofactor.WithEngine(e.engine))
+			require.NoError(t, err, c.name)
+			out, err := r.Apply("package main\n\nfunc main() {\n\t" + c.code + "\n}\n")
+			require.NoError(t, err, c.name)
+			require.Equal(t, "package main\n\nfunc main() {\n\t"+c.exp+"\n}\n", out, c.name+" "+e.name)
+		}
+	}
+}
+
+// exported matches exported identifiers
+type exported struct{}
+
+func (exported) Kinds() nodes.Kind {
+	return nodes.KindObject
+}
+
+func (exported) Check(st *transformer.State, n nodes.Node) (bool, error) {
+	obj, ok := n.(nodes.Object)
+	if !ok || uast.TypeOf(obj) != "Ident" {
+		return false, nil
+	}
+	name, _ := obj["Name"].(nodes.String)
+	return ast.IsExported(string(name)), nil
+}
+
+func exportedOp(name string) transformer.Op {
+	return transformer.Check(exported{}, vartransform.Var(name))
+}
+
+func ExampleRegisterOp() {
+	if err := gofactor.RegisterOp("exported", exportedOp); err != nil {
+		panic(err)
+	}
+	r, err := gofactor.NewRefactor("X1.$X2:exported = X3", "X1.Set($quote(X2), X3)")
+	if err != nil {
+		panic(err)
+	}
+	out, err := r.Apply("package main\n\nfunc main() {\n\tc.Name = n\n\tc.name = n\n}\n")
+	if err != nil {
+		panic(err)
+	}
+	fmt.Print(out)
+	// Output:
+	// package main
+	//
+	// func main() {
+	//	c.Set("Name", n)
+	//	c.name = n
+	// }
+}
+
+func TestCustomOps(t *testing.T) {
+	require.Error(t, gofactor.RegisterOp("not exported", exportedOp))
+	require.Error(t, gofactor.RegisterOp("nilOp", nil))
+	require.NoError(t, gofactor.RegisterOp("exported", exportedOp))
+
+	const code = "package main\n\nfunc main() {\n\ta := Name\n\tb := name\n}\n"
+	for _, e := range engines {
+		r, err := gofactor.NewRefactor("X1 := $X2:exported", "$X1:exported := X2", gofactor.WithEngine(e.engine))
+		require.NoError(t, err)
+		require.Empty(t, r.Warnings())
+		out, err := r.Apply(code)
+		require.NoError(t, err, e.name)
+		require.Equal(t, "package main\n\nfunc main() {\n\ta := Name\n\tb := name\n}\n", out, e.name)
+
+		r, err = gofactor.NewRefactor("X1 := $X2:exported", "X1 := $toLower(X2)", gofactor.WithEngine(e.engine))
+		require.NoError(t, err)
+		out, err = r.Apply(code)
+		require.NoError(t, err, e.name)
+		require.Equal(t, "package main\n\nfunc main() {\n\ta := name\n\tb := name\n}\n", out, e.name)
+	}
+
+	for _, c := range []struct{ before, after string }{
+		{before: "X1 := $X2:unknown", after: "X1 := X2"},
+		{before: "X1 := $X2", after: "X1 := X2"},
+		{before: "X1 := $name:exported", after: "X1 := name"},
+		{before: "X1 := $X2:exported", after: "X1 := X3"},
+	} {
+		_, err := gofactor.NewRefactor(c.before, c.after)
+		require.Error(t, err, c.before)
+	}
 }
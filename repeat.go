@@ -0,0 +1,444 @@
+package gofactor
+
+import (
+	"errors"
+	"fmt"
+	"go/ast"
+	"sort"
+	"strings"
+
+	"github.com/bblfsh/sdk/v3/uast"
+	"github.com/bblfsh/sdk/v3/uast/nodes"
+	"github.com/bblfsh/sdk/v3/uast/transformer"
+)
+
+const (
+	// repeatName is the name of the marker of repeated branches in snippets, it is called as $repeat(...):
+	// an else-if branch with $repeat(cond) condition matches any number of consecutive else-if branches, a clause
+	// starting with 'case $repeat(exprs):' matches any number of consecutive clauses of a switch, and a block
+	// consisting of $repeat(X1) statement only matches any number of statements
+	repeatName = "repeat"
+	// repeatFunc is the name of the marker after expandOps, the prefix is a letter, so the result is a valid
+	// identifier that can't clash with functions of the code
+	repeatFunc = "ǃ" + repeatName
+)
+
+// repeatArgs returns arguments of the call if it is the repeat marker
+func repeatArgs(n nodes.Node) (nodes.Array, bool) {
+	obj, ok := n.(nodes.Object)
+	if !ok || uast.TypeOf(obj) != "CallExpr" {
+		return nil, false
+	}
+	fun, ok := obj["Fun"].(nodes.Object)
+	if !ok || uast.TypeOf(fun) != "Ident" || fun["Name"] != nodes.String(repeatFunc) {
+		return nil, false
+	}
+	args, _ := obj["Args"].(nodes.Array)
+	return args, len(args) != 0
+}
+
+// isRepeatCall is like repeatArgs, but for Go AST
+func isRepeatCall(e ast.Expr) bool {
+	call, ok := e.(*ast.CallExpr)
+	if !ok || len(call.Args) == 0 {
+		return false
+	}
+	fun, ok := call.Fun.(*ast.Ident)
+	return ok && fun.Name == repeatFunc
+}
+
+// repeatedIf returns a single branch of the repeated else-if branch n, and the rest of the chain
+func repeatedIf(n nodes.Node) (nodes.Object, nodes.Node, bool) {
+	obj, ok := n.(nodes.Object)
+	if !ok || uast.TypeOf(obj) != "IfStmt" {
+		return nil, nil, false
+	}
+	args, ok := repeatArgs(obj["Cond"])
+	if !ok || len(args) != 1 {
+		return nil, nil, false
+	}
+	elem := obj.CloneObject()
+	elem["Cond"] = args[0]
+	delete(elem, "Else")
+	return elem, obj["Else"], true
+}
+
+// repeatedClause returns a single clause of the repeated clause n
+func repeatedClause(n nodes.Node) (nodes.Object, bool) {
+	obj, ok := n.(nodes.Object)
+	if !ok || uast.TypeOf(obj) != "CaseClause" {
+		return nil, false
+	}
+	list, _ := obj["List"].(nodes.Array)
+	if len(list) != 1 {
+		return nil, false
+	}
+	args, ok := repeatArgs(list[0])
+	if !ok {
+		return nil, false
+	}
+	elem := obj.CloneObject()
+	elem["List"] = args
+	return elem, true
+}
+
+// walkOutside walks the tree in depth-first order skipping repeated branches, children of the node are walked only
+// if fn returns true
+func walkOutside(n nodes.Node, fn func(n nodes.Node) bool) {
+	if !fn(n) {
+		return
+	}
+	switch o := n.(type) {
+	case nodes.Object:
+		for k, v := range o {
+			if k == "Else" {
+				if _, tail, ok := repeatedIf(v); ok {
+					walkOutside(tail, fn)
+					continue
+				}
+			}
+			walkOutside(v, fn)
+		}
+	case nodes.Array:
+		for _, v := range o {
+			if _, ok := repeatedClause(v); !ok {
+				walkOutside(v, fn)
+			}
+		}
+	}
+}
+
+// repeatedBranches returns single branches of repeated branches of the snippet, which are not nested into other
+// repeated branches
+func repeatedBranches(n nodes.Node) ([]nodes.Object, error) {
+	var (
+		elems []nodes.Object
+		err   error
+	)
+	walkOutside(n, func(n nodes.Node) bool {
+		switch o := n.(type) {
+		case nodes.Object:
+			if elem, _, ok := repeatedIf(o["Else"]); ok {
+				elems = append(elems, elem)
+			}
+		case nodes.Array:
+			cnt := 0
+			for _, v := range o {
+				if elem, ok := repeatedClause(v); ok {
+					elems = append(elems, elem)
+					cnt++
+				}
+			}
+			if cnt > 1 {
+				err = errors.New("switch statement contains more than one repeated clause")
+			}
+		}
+		return true
+	})
+	return elems, err
+}
+
+// outsideVars returns metavariables used outside of repeated branches
+func outsideVars(n nodes.Node) map[string]struct{} {
+	vars := make(map[string]struct{})
+	walkOutside(n, func(n nodes.Node) bool {
+		if obj, ok := n.(nodes.Object); ok && uast.TypeOf(obj) == "Ident" {
+			if name, ok := obj["Name"].(nodes.String); ok && isMetaVar(string(name)) {
+				vars[varName(string(name))] = struct{}{}
+			}
+			return false
+		}
+		return true
+	})
+	return vars
+}
+
+// repeats describes repeated branches of a rule.
+// Metavariables bound outside of repeated branches of before snippet are shared: they must be the same in all
+// branches. Other metavariables of a repeated branch are its own: they are bound in each branch separately and may be
+// used only in a single repeated branch of after snippet.
+type repeats struct {
+	shared map[string]struct{}
+	// branches maps state variables of repeated branches of before snippet to their own metavariables
+	branches map[string]map[string]struct{}
+}
+
+func newRepeats(in, out nodes.Node) (*repeats, error) {
+	rep := &repeats{
+		shared:   outsideVars(in),
+		branches: make(map[string]map[string]struct{}),
+	}
+	for _, n := range in.(nodes.Array) {
+		if _, ok := repeatedClause(n); ok {
+			return nil, errors.New("repeated clauses are only supported inside of a switch statement")
+		}
+	}
+
+	inElems, err := repeatedBranches(in)
+	if err != nil {
+		return nil, err
+	}
+	owners := make(map[string]string)
+	for _, elem := range inElems {
+		if nested, _ := repeatedBranches(elem); len(nested) != 0 {
+			return nil, errors.New("repeated branches can't be nested")
+		}
+		own := rep.ownVars(elem)
+		if len(own) == 0 {
+			return nil, errors.New("repeated branch of before snippet does not bind metavariables of its own")
+		}
+		name := repeatVar(own)
+		for v := range own {
+			if _, ok := owners[v]; ok {
+				return nil, fmt.Errorf("metavariable %s is bound by several repeated branches", v)
+			}
+			owners[v] = name
+		}
+		rep.branches[name] = own
+	}
+
+	for v := range outsideVars(out) {
+		if _, ok := owners[v]; ok {
+			return nil, fmt.Errorf("metavariable %s is bound by a repeated branch and can't be used outside of it", v)
+		}
+	}
+	outElems, err := repeatedBranches(out)
+	if err != nil {
+		return nil, err
+	}
+	for _, elem := range outElems {
+		if rep.name(elem) == "" {
+			return nil, errors.New("repeated branch of after snippet must use metavariables of a single repeated branch of before snippet")
+		}
+	}
+	return rep, nil
+}
+
+// ownVars returns metavariables of the repeated branch that are not shared
+func (rep *repeats) ownVars(elem nodes.Object) map[string]struct{} {
+	own := make(map[string]struct{})
+	for v := range metaVars(elem) {
+		if _, ok := rep.shared[v]; !ok && !isFreshVar(v) {
+			own[v] = struct{}{}
+		}
+	}
+	return own
+}
+
+// name returns the state variable of the repeated branch of before snippet the branch belongs to, or an empty string
+func (rep *repeats) name(elem nodes.Object) string {
+	own := rep.ownVars(elem)
+	if len(own) == 0 {
+		return ""
+	}
+loop:
+	for name, vars := range rep.branches {
+		for v := range own {
+			if _, ok := vars[v]; !ok {
+				continue loop
+			}
+		}
+		return name
+	}
+	return ""
+}
+
+// repeatVar returns the name of state variable that keeps states of repeated branches with given metavariables
+func repeatVar(vars map[string]struct{}) string {
+	names := make([]string, 0, len(vars))
+	for v := range vars {
+		names = append(names, v)
+	}
+	sort.Strings(names)
+	return repeatFunc + ":" + strings.Join(names, ",")
+}
+
+// bindRepeated stores states of matched repeated branches and binds shared metavariables of the branches
+func bindRepeated(st *transformer.State, name string, shared map[string]struct{}, subs []*transformer.State) (bool, error) {
+	for _, sub := range subs {
+		for v := range shared {
+			val, ok := sub.GetVar(v)
+			if !ok {
+				continue
+			}
+			if err := st.SetVar(v, val); err != nil {
+				if transformer.ErrVariableRedeclared.Is(err) {
+					return false, nil
+				}
+				return false, err
+			}
+		}
+	}
+	if err := st.SetStateVar(name, subs); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// branchState returns the state to construct a repeated branch with
+func branchState(st, sub *transformer.State) *transformer.State {
+	bst := st.Clone()
+	bst.ApplyFrom(sub)
+	return bst
+}
+
+// opRepeatIf matches a chain of else-if branches: leading branches of the chain are checked against elem, each in its
+// own state, and the rest of the chain is checked against tail
+type opRepeatIf struct {
+	name   string
+	shared map[string]struct{}
+	elem   transformer.Op
+	tail   transformer.Op
+}
+
+func (op opRepeatIf) Kinds() nodes.Kind {
+	return nodes.KindsAny
+}
+
+func (op opRepeatIf) Check(st *transformer.State, n nodes.Node) (bool, error) {
+	var (
+		subs []*transformer.State
+		// rests[i] is the rest of the chain after i branches
+		rests = []nodes.Node{n}
+	)
+	for {
+		obj, ok := rests[len(rests)-1].(nodes.Object)
+		if !ok || uast.TypeOf(obj) != "IfStmt" {
+			break
+		}
+		elem := obj.CloneObject()
+		delete(elem, "Else")
+		sub := transformer.NewState()
+		if ok, err := op.elem.Check(sub, elem); err != nil {
+			return false, err
+		} else if !ok {
+			break
+		}
+		subs = append(subs, sub)
+		rests = append(rests, obj["Else"])
+	}
+
+	// the longest chain is tried first
+	for i := len(subs); i >= 0; i-- {
+		cst := st.Clone()
+		if ok, err := bindRepeated(cst, op.name, op.shared, subs[:i]); err != nil {
+			return false, err
+		} else if !ok {
+			continue
+		}
+		if ok, err := op.tail.Check(cst, rests[i]); err != nil {
+			return false, err
+		} else if !ok {
+			continue
+		}
+		st.ApplyFrom(cst)
+		return true, nil
+	}
+	return false, nil
+}
+
+func (op opRepeatIf) Construct(st *transformer.State, n nodes.Node) (nodes.Node, error) {
+	if n != nil {
+		return nil, transformer.ErrUnexpectedNode.New(n)
+	}
+	subs, ok := st.GetStateVar(op.name)
+	if !ok {
+		return nil, transformer.ErrVariableNotDefined.New(op.name)
+	}
+	chain, err := op.tail.Construct(st, nil)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(subs) - 1; i >= 0; i-- {
+		nn, err := op.elem.Construct(branchState(st, subs[i]), nil)
+		if err != nil {
+			return nil, err
+		}
+		obj, ok := nn.(nodes.Object)
+		if !ok {
+			return nil, transformer.ErrUnexpectedType.New(nodes.Object{}, nn)
+		}
+		obj["Else"] = chain
+		chain = obj
+	}
+	return chain, nil
+}
+
+// opRepeatArr matches an array with any number of elements matching elem between prefix and suffix elements, each
+// repeated element is checked in its own state
+type opRepeatArr struct {
+	name   string
+	shared map[string]struct{}
+	prefix []transformer.Op
+	elem   transformer.Op
+	suffix []transformer.Op
+}
+
+func (op opRepeatArr) Kinds() nodes.Kind {
+	return nodes.KindNil | nodes.KindArray
+}
+
+func (op opRepeatArr) Check(st *transformer.State, n nodes.Node) (bool, error) {
+	arr, ok := n.(nodes.Array)
+	if !ok && n != nil {
+		return false, nil
+	}
+	if len(arr) < len(op.prefix)+len(op.suffix) {
+		return false, nil
+	}
+	mid := arr[len(op.prefix) : len(arr)-len(op.suffix)]
+	for i, sop := range op.prefix {
+		if ok, err := sop.Check(st, arr[i]); err != nil || !ok {
+			return false, err
+		}
+	}
+	for i, sop := range op.suffix {
+		if ok, err := sop.Check(st, arr[len(arr)-len(op.suffix)+i]); err != nil || !ok {
+			return false, err
+		}
+	}
+
+	subs := make([]*transformer.State, 0, len(mid))
+	for _, el := range mid {
+		sub := transformer.NewState()
+		if ok, err := op.elem.Check(sub, el); err != nil || !ok {
+			return false, err
+		}
+		subs = append(subs, sub)
+	}
+	return bindRepeated(st, op.name, op.shared, subs)
+}
+
+func (op opRepeatArr) Construct(st *transformer.State, n nodes.Node) (nodes.Node, error) {
+	if n != nil {
+		return nil, transformer.ErrUnexpectedNode.New(n)
+	}
+	subs, ok := st.GetStateVar(op.name)
+	if !ok {
+		return nil, transformer.ErrVariableNotDefined.New(op.name)
+	}
+
+	arr := make(nodes.Array, 0, len(op.prefix)+len(subs)+len(op.suffix))
+	for _, sop := range op.prefix {
+		nn, err := sop.Construct(st, nil)
+		if err != nil {
+			return nil, err
+		}
+		arr = append(arr, nn)
+	}
+	for _, sub := range subs {
+		nn, err := op.elem.Construct(branchState(st, sub), nil)
+		if err != nil {
+			return nil, err
+		}
+		arr = append(arr, nn)
+	}
+	for _, sop := range op.suffix {
+		nn, err := sop.Construct(st, nil)
+		if err != nil {
+			return nil, err
+		}
+		arr = append(arr, nn)
+	}
+	return arr, nil
+}
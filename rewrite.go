@@ -0,0 +1,182 @@
+package gofactor
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/printer"
+	"go/token"
+
+	"github.com/bblfsh/sdk/v3/uast/nodes"
+	"github.com/lwsanty/gofactor/golang"
+)
+
+// rewrite parses the code, applies the rules to it with the configured engine and prints the result
+// with imports fixed
+func rewrite(code string, conf config, d *dispatcher) (string, bool, error) {
+	if conf.tolerant {
+		return rewriteTolerant(code, conf, d)
+	}
+	return rewriteCode(code, conf, d, nil)
+}
+
+// rewriteCode is like rewrite, but always fails on syntax errors. Imports of packages in used are never removed.
+func rewriteCode(code string, conf config, d *dispatcher, used map[string]struct{}) (string, bool, error) {
+	var (
+		out     string
+		changed bool
+		err     error
+	)
+	switch conf.engine {
+	case EngineAST:
+		out, changed, err = rewriteAST(code, conf, d)
+	default:
+		out, changed, err = rewriteUAST(code, conf, d)
+	}
+	if err != nil || !changed {
+		return out, changed, err
+	}
+	out, err = fixImports(code, out, d.imports(), used)
+	if err != nil {
+		return "", false, err
+	}
+	return out, true, nil
+}
+
+func rewriteUAST(code string, conf config, d *dispatcher) (string, bool, error) {
+	f, fs, err := golang.ParseString(code)
+	if err != nil {
+		return "", false, err
+	}
+	names := d.qualify(f)
+	if conf.scopes {
+		resolveObjects(f)
+	}
+
+	tree, err := golang.ValueToNode(f, fs)
+	if err != nil {
+		return "", false, err
+	}
+	tree, err = trimPositions(tree)
+	if err != nil {
+		return "", false, err
+	}
+
+	// debug
+	// dump(tree, "../out/test.yml")
+
+	changed, err := fixpoint(conf, func() (bool, error) {
+		nn, ok, err := d.transform(tree)
+		if ok {
+			tree = nn
+		}
+		return ok, err
+	}, func() (nodes.Hash, error) {
+		return nodes.HashOf(tree), nil
+	})
+	if err != nil {
+		return "", false, err
+	} else if !changed {
+		return code, false, nil
+	}
+	out := golang.NodeToAST(tree)
+	unresolveObjects(out)
+	d.unqualify(out, names)
+	nameFresh(out)
+	return print(out)
+}
+
+func rewriteAST(code string, conf config, d *dispatcher) (string, bool, error) {
+	f, fs, err := golang.ParseString(code)
+	if err != nil {
+		return "", false, err
+	}
+	names := d.qualify(f)
+	if conf.scopes {
+		resolveObjects(f)
+	}
+
+	changed, err := fixpoint(conf, func() (bool, error) {
+		return d.transformAST(f, fs)
+	}, func() (nodes.Hash, error) {
+		buf := &bytes.Buffer{}
+		if err := printer.Fprint(buf, fs, f); err != nil {
+			return nodes.Hash{}, err
+		}
+		return sha256.Sum256(buf.Bytes()), nil
+	})
+	if err != nil {
+		return "", false, err
+	} else if !changed {
+		return code, false, nil
+	}
+	// positions are dropped to get the same output as with UAST engine
+	golang.ClearPositions(f)
+	unresolveObjects(f)
+	d.unqualify(f, names)
+	nameFresh(f)
+	return print(f)
+}
+
+// print prints the file and formats the output
+func print(n ast.Node) (string, bool, error) {
+	buf := &bytes.Buffer{}
+	if err := printer.Fprint(buf, token.NewFileSet(), n); err != nil {
+		return "", false, err
+	}
+
+	fdata, err := format.Source(buf.Bytes())
+	if err != nil {
+		return "", false, err
+	}
+
+	return string(fdata), true, nil
+}
+
+// fixpoint runs the pass once, or, if enabled, repeatedly until the tree stops changing.
+// In the latter case it fails if the tree returns to one of the previous states or the iteration limit is reached;
+// hash is used to compare tree states.
+func fixpoint(conf config, pass func() (bool, error), hash func() (nodes.Hash, error)) (bool, error) {
+	var (
+		cur  nodes.Hash
+		seen map[nodes.Hash]struct{}
+	)
+	if conf.maxIterations > 0 {
+		h, err := hash()
+		if err != nil {
+			return false, err
+		}
+		cur, seen = h, map[nodes.Hash]struct{}{h: {}}
+	}
+	changed := false
+	for i := 0; i == 0 || i < conf.maxIterations; i++ {
+		ok, err := pass()
+		if err != nil {
+			return false, err
+		} else if !ok {
+			return changed, nil
+		}
+		if seen != nil {
+			h, err := hash()
+			if err != nil {
+				return false, err
+			}
+			if h == cur {
+				// rules matched, but produced the same tree
+				return changed, nil
+			}
+			if _, ok := seen[h]; ok {
+				return false, fmt.Errorf("rules do not converge: the tree returned to a previous state on iteration %d", i+1)
+			}
+			seen[h] = struct{}{}
+			cur = h
+		}
+		changed = true
+	}
+	if conf.maxIterations > 0 {
+		return false, fmt.Errorf("rules do not converge in %d iterations", conf.maxIterations)
+	}
+	return changed, nil
+}
@@ -0,0 +1,235 @@
+package gofactor
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"go/token"
+	"sort"
+
+	"github.com/lwsanty/gofactor/golang"
+)
+
+// RuleSet is an ordered list of refactoring rules applied to the code together.
+// All rules are applied in a single tree traversal: for each statement block rules are tried in order,
+// each rule sees the result of the previous one, so the first rule wins if two rules match the same statements.
+type RuleSet struct {
+	rules []*Refactor
+	opts  []Option
+	conf  config
+	d     *dispatcher
+}
+
+// NewRuleSet creates a rule set from the rules. Rules are ordered by priority, rules with the same priority keep
+// their order.
+// Matching strategy and priority are defined by each rule, while Fixpoint and engine options are taken from the set only.
+func NewRuleSet(rules []*Refactor, opts ...Option) *RuleSet {
+	rules = append([]*Refactor{}, rules...)
+	sort.SliceStable(rules, func(i, j int) bool {
+		return rules[i].conf.priority > rules[j].conf.priority
+	})
+	conf := newConfig(opts)
+	return &RuleSet{
+		rules: rules,
+		opts:  opts,
+		conf:  conf,
+		d:     newDispatcher(rules, conf),
+	}
+}
+
+// Rules returns rules of the set in order of application
+func (s *RuleSet) Rules() []*Refactor {
+	return s.rules
+}
+
+// ruleName returns a name of i-th rule of the set, or its number if the rule has no name
+func ruleName(rules []*Refactor, i int) string {
+	if name := rules[i].Name(); name != "" {
+		return name
+	}
+	return fmt.Sprintf("#%d", i+1)
+}
+
+// Apply applies all rules to the code. If nothing matched, the code is returned as is.
+func (s *RuleSet) Apply(code string) (string, error) {
+	out, _, err := s.Rewrite(code)
+	return out, err
+}
+
+// Rewrite is like Apply, but also reports whether the code was changed
+func (s *RuleSet) Rewrite(code string) (string, bool, error) {
+	if !s.mayMatch(code) {
+		return code, false, nil
+	}
+	return rewrite(code, s.conf, s.d)
+}
+
+func (s *RuleSet) mayMatch(code string) bool {
+	for _, r := range s.rules {
+		if r.mayMatch(code) {
+			return true
+		}
+	}
+	return false
+}
+
+// Inverse returns a rule set that undoes the current one: all rules are inverted and applied in reverse order
+func (s *RuleSet) Inverse() (*RuleSet, error) {
+	inv := make([]*Refactor, 0, len(s.rules))
+	for i := len(s.rules) - 1; i >= 0; i-- {
+		r, err := s.rules[i].Inverse()
+		if err != nil {
+			return nil, fmt.Errorf("rule %s: %v", ruleName(s.rules, i), err)
+		}
+		inv = append(inv, r)
+	}
+	return NewRuleSet(inv, s.opts...), nil
+}
+
+// Warnings returns warnings of all rules of the set
+func (s *RuleSet) Warnings() []string {
+	var res []string
+	for i, r := range s.rules {
+		for _, w := range r.Warnings() {
+			res = append(res, fmt.Sprintf("rule %s: %s", ruleName(s.rules, i), w))
+		}
+	}
+	return res
+}
+
+// Hash returns a digest of all rules and options of the set that can be used as a cache key
+func (s *RuleSet) Hash() string {
+	h := sha256.New()
+	for _, r := range s.rules {
+		fmt.Fprintln(h, r.Hash())
+	}
+	fmt.Fprintf(h, "%+v\n", s.conf)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Conflict describes two rules of a set that match overlapping code, so the result depends on the order of rules
+type Conflict struct {
+	// Rules are names of the rules in order of application
+	Rules [2]string
+	// Pos are positions of the code matched by each rule
+	Pos [2]token.Position
+}
+
+func (c Conflict) String() string {
+	return fmt.Sprintf("%v: rule %s overlaps with rule %s matched at %v", c.Pos[1], c.Rules[1], c.Rules[0], c.Pos[0])
+}
+
+// Match is code matched by a rule of a set
+type Match struct {
+	// Rule is the name of the rule
+	Rule string
+	// Pos and End are positions of the beginning and the end of the matched code
+	Pos, End token.Position
+}
+
+func (m Match) String() string {
+	return fmt.Sprintf("%v: rule %s matched", m.Pos, m.Rule)
+}
+
+// Matches finds code matched by the rules in the original code, in order of positions. Unlike Rewrite, it doesn't
+// find matches that appear only after other rewrites.
+func (s *RuleSet) Matches(code string) ([]Match, error) {
+	regions, fs, err := s.regions(code)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]Match, 0, len(regions))
+	for _, r := range regions {
+		res = append(res, Match{Rule: ruleName(s.rules, r.rule), Pos: fs.Position(r.pos), End: fs.Position(r.end)})
+	}
+	return res, nil
+}
+
+// region is code matched by a rule of a set
+type region struct {
+	rule     int
+	pos, end token.Pos
+}
+
+// regions returns code matched by the rules sorted by position
+func (s *RuleSet) regions(code string) ([]region, *token.FileSet, error) {
+	f, fs, err := golang.ParseString(code)
+	if err != nil {
+		return nil, nil, err
+	}
+	s.d.qualify(f)
+
+	var regions []region
+	for _, list := range stmtLists(f) {
+		stmts := *list
+		for i, r := range s.rules {
+			starts, _, err := r.match(stmts, fs, 0)
+			if err != nil {
+				return nil, nil, err
+			}
+			for _, start := range starts {
+				regions = append(regions, region{
+					rule: i,
+					pos:  stmts[start].Pos(),
+					end:  stmts[start+len(r.stmts)-1].End(),
+				})
+			}
+		}
+	}
+	sort.SliceStable(regions, func(i, j int) bool {
+		return regions[i].pos < regions[j].pos
+	})
+	return regions, fs, nil
+}
+
+// Conflicts finds rules that match overlapping code
+func (s *RuleSet) Conflicts(code string) ([]Conflict, error) {
+	regions, fs, err := s.regions(code)
+	if err != nil {
+		return nil, err
+	}
+
+	var res []Conflict
+	for i, a := range regions {
+		for _, b := range regions[i+1:] {
+			if b.pos >= a.end {
+				break
+			} else if a.rule == b.rule {
+				continue
+			}
+			first, second := a, b
+			if first.rule > second.rule {
+				first, second = second, first
+			}
+			res = append(res, Conflict{
+				Rules: [2]string{ruleName(s.rules, first.rule), ruleName(s.rules, second.rule)},
+				Pos:   [2]token.Position{fs.Position(first.pos), fs.Position(second.pos)},
+			})
+		}
+	}
+	return res, nil
+}
+
+// Lint statically checks the rules and reports pairs of rules where one rule subsumes another one
+func (s *RuleSet) Lint() ([]string, error) {
+	var res []string
+	for i, a := range s.rules {
+		for j, b := range s.rules {
+			if i == j {
+				continue
+			}
+			ok, err := a.Subsumes(b)
+			if err != nil {
+				return nil, err
+			} else if !ok {
+				continue
+			}
+			msg := fmt.Sprintf("rule %s subsumes rule %s: code matched by %[2]s is matched by %[1]s as well", ruleName(s.rules, i), ruleName(s.rules, j))
+			if i < j {
+				msg += fmt.Sprintf(", and %s is applied first", ruleName(s.rules, i))
+			}
+			res = append(res, msg)
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,69 @@
+package gofactor
+
+import (
+	"go/ast"
+	"strconv"
+	"strings"
+
+	"github.com/bblfsh/sdk/v3/uast/nodes"
+	"github.com/bblfsh/sdk/v3/uast/transformer"
+)
+
+// objectSeparator separates names of identifiers from ids of the objects they refer to in scope-aware mode
+const objectSeparator = "#"
+
+// resolveObjects appends ids of declared objects to names of identifiers referring to them, so identifiers are equal
+// only if they refer to the same object
+func resolveObjects(f *ast.File) {
+	ids := make(map[*ast.Object]int)
+	ast.Inspect(f, func(n ast.Node) bool {
+		id, ok := n.(*ast.Ident)
+		if !ok || id.Obj == nil || id.Name == "_" {
+			return true
+		}
+		num, ok := ids[id.Obj]
+		if !ok {
+			num = len(ids) + 1
+			ids[id.Obj] = num
+		}
+		id.Name += objectSeparator + strconv.Itoa(num)
+		return true
+	})
+}
+
+// unresolveObjects restores names of identifiers changed by resolveObjects
+func unresolveObjects(n ast.Node) {
+	ast.Inspect(n, func(n ast.Node) bool {
+		if id, ok := n.(*ast.Ident); ok {
+			id.Name = baseName(id.Name)
+		}
+		return true
+	})
+}
+
+// baseName returns the name of the identifier without the object id
+func baseName(name string) string {
+	if i := strings.Index(name, objectSeparator); i >= 0 {
+		return name[:i]
+	}
+	return name
+}
+
+// opName matches names of identifiers ignoring object ids, so identifiers of snippets match any object
+type opName string
+
+func (op opName) Kinds() nodes.Kind {
+	return nodes.KindString
+}
+
+func (op opName) Check(st *transformer.State, n nodes.Node) (bool, error) {
+	name, ok := n.(nodes.String)
+	return ok && baseName(string(name)) == string(op), nil
+}
+
+func (op opName) Construct(st *transformer.State, n nodes.Node) (nodes.Node, error) {
+	if n != nil {
+		return nil, transformer.ErrUnexpectedNode.New(n)
+	}
+	return nodes.String(op), nil
+}
@@ -0,0 +1,472 @@
+package gofactor
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/token"
+	"strconv"
+
+	"github.com/lwsanty/gofactor/golang"
+)
+
+// TailRecSkip describes a self-recursive function that is not rewritten into a loop
+type TailRecSkip struct {
+	// Pos is the position of the code that prevents the rewrite
+	Pos    token.Position
+	Func   string
+	Reason string
+}
+
+func (s TailRecSkip) String() string {
+	return fmt.Sprintf("%v: function %s is not rewritten: %s", s.Pos, s.Func, s.Reason)
+}
+
+// TailRec rewrites self-recursive functions of the file, whose recursive calls are all in tail position, into loops
+// reassigning parameters. Functions where the rewrite is unsafe, because of defer statements, closures capturing
+// parameters or modified named results, are left as is and reported.
+func TailRec(code string) (string, bool, []TailRecSkip, error) {
+	f, fs, err := golang.ParseString(code)
+	if err != nil {
+		return "", false, nil, err
+	}
+
+	var (
+		changed bool
+		skips   []TailRecSkip
+	)
+	for _, decl := range f.Decls {
+		fn, ok := decl.(*ast.FuncDecl)
+		if !ok || fn.Recv != nil || fn.Body == nil {
+			continue
+		}
+		t := newTailRec(fn)
+		if len(t.calls) == 0 {
+			continue
+		}
+		if pos, reason := t.check(); reason != "" {
+			skips = append(skips, TailRecSkip{Pos: fs.Position(pos), Func: fn.Name.Name, Reason: reason})
+			continue
+		}
+		t.rewrite()
+		changed = true
+	}
+	if !changed {
+		return code, false, skips, nil
+	}
+	// the file is printed with original positions, so comments stay in place; new nodes get positions of the code
+	// they replace
+	buf := &bytes.Buffer{}
+	if err := format.Node(buf, fs, f); err != nil {
+		return "", false, nil, err
+	}
+	return buf.String(), true, skips, nil
+}
+
+// tailSite is a recursive call in tail position: either 'return f(args)', or 'f(args)' in a function without results
+// that is followed by a bare return or ends the function
+type tailSite struct {
+	list *[]ast.Stmt
+	// i is the index of the statement with the call in the list, n is the number of statements the site takes
+	i, n int
+	call *ast.CallExpr
+	// inLoop is set if the site is nested into a loop of the function
+	inLoop bool
+}
+
+// tailRec rewrites a single self-recursive function
+type tailRec struct {
+	fn *ast.FuncDecl
+	// calls are all recursive calls of the function, including the ones in closures
+	calls []*ast.CallExpr
+	sites []tailSite
+	// end are call statements that end the function, so the function returns after them
+	end             map[ast.Stmt]bool
+	params, results map[*ast.Object]bool
+}
+
+func newTailRec(fn *ast.FuncDecl) *tailRec {
+	t := &tailRec{
+		fn:      fn,
+		end:     make(map[ast.Stmt]bool),
+		params:  fieldObjects(fn.Type.Params),
+		results: fieldObjects(fn.Type.Results),
+	}
+	ast.Inspect(fn.Body, func(n ast.Node) bool {
+		if call, ok := n.(*ast.CallExpr); ok && t.isSelf(call.Fun) {
+			t.calls = append(t.calls, call)
+		}
+		return true
+	})
+	if len(t.calls) == 0 {
+		return t
+	}
+	t.markEnd(fn.Body.List)
+	t.findSites(&fn.Body.List, false)
+	return t
+}
+
+func fieldObjects(fields *ast.FieldList) map[*ast.Object]bool {
+	objs := make(map[*ast.Object]bool)
+	if fields == nil {
+		return objs
+	}
+	for _, field := range fields.List {
+		for _, name := range field.Names {
+			if name.Obj != nil {
+				objs[name.Obj] = true
+			}
+		}
+	}
+	return objs
+}
+
+// isSelf reports whether the expression refers to the function itself
+func (t *tailRec) isSelf(e ast.Expr) bool {
+	switch x := unparen(e).(type) {
+	case *ast.Ident:
+		return x.Obj != nil && x.Obj == t.fn.Name.Obj
+	case *ast.IndexExpr:
+		return t.isSelf(x.X)
+	case *ast.IndexListExpr:
+		return t.isSelf(x.X)
+	}
+	return false
+}
+
+// selfCall returns the expression if it is a recursive call
+func (t *tailRec) selfCall(e ast.Expr) (*ast.CallExpr, bool) {
+	call, ok := unparen(e).(*ast.CallExpr)
+	if !ok || !t.isSelf(call.Fun) {
+		return nil, false
+	}
+	return call, true
+}
+
+// markEnd marks call statements the function returns after, starting from the statement list
+func (t *tailRec) markEnd(list []ast.Stmt) {
+	if len(list) == 0 {
+		return
+	}
+	switch s := list[len(list)-1].(type) {
+	case *ast.ExprStmt:
+		t.end[s] = true
+	case *ast.BlockStmt:
+		t.markEnd(s.List)
+	case *ast.IfStmt:
+		t.markEnd(s.Body.List)
+		if s.Else != nil {
+			t.markEnd([]ast.Stmt{s.Else})
+		}
+	}
+}
+
+// findSites finds recursive calls in tail position in the statement list and nested lists, except ones of closures
+func (t *tailRec) findSites(list *[]ast.Stmt, inLoop bool) {
+	noResults := t.fn.Type.Results.NumFields() == 0
+	for i, stmt := range *list {
+		switch s := stmt.(type) {
+		case *ast.ReturnStmt:
+			if len(s.Results) != 1 || noResults {
+				continue
+			}
+			if call, ok := t.selfCall(s.Results[0]); ok {
+				t.sites = append(t.sites, tailSite{list: list, i: i, n: 1, call: call, inLoop: inLoop})
+			}
+			continue
+		case *ast.ExprStmt:
+			call, ok := t.selfCall(s.X)
+			if !ok || !noResults {
+				continue
+			}
+			if i+1 < len(*list) {
+				if ret, ok := (*list)[i+1].(*ast.ReturnStmt); ok && len(ret.Results) == 0 {
+					t.sites = append(t.sites, tailSite{list: list, i: i, n: 2, call: call, inLoop: inLoop})
+					continue
+				}
+			}
+			if t.end[s] {
+				t.sites = append(t.sites, tailSite{list: list, i: i, n: 1, call: call, inLoop: inLoop})
+			}
+			continue
+		}
+		t.findNested(stmt, inLoop)
+	}
+}
+
+// findNested finds recursive calls in tail position in statement lists nested into the statement
+func (t *tailRec) findNested(stmt ast.Stmt, inLoop bool) {
+	switch s := stmt.(type) {
+	case *ast.BlockStmt:
+		t.findSites(&s.List, inLoop)
+	case *ast.LabeledStmt:
+		t.findNested(s.Stmt, inLoop)
+	case *ast.IfStmt:
+		t.findSites(&s.Body.List, inLoop)
+		if s.Else != nil {
+			t.findNested(s.Else, inLoop)
+		}
+	case *ast.ForStmt:
+		t.findSites(&s.Body.List, true)
+	case *ast.RangeStmt:
+		t.findSites(&s.Body.List, true)
+	case *ast.SwitchStmt:
+		t.findNested(s.Body, inLoop)
+	case *ast.TypeSwitchStmt:
+		t.findNested(s.Body, inLoop)
+	case *ast.SelectStmt:
+		t.findNested(s.Body, inLoop)
+	case *ast.CaseClause:
+		t.findSites(&s.Body, inLoop)
+	case *ast.CommClause:
+		t.findSites(&s.Body, inLoop)
+	}
+}
+
+// check returns the position and the reason if the function can't be rewritten safely
+func (t *tailRec) check() (token.Pos, string) {
+	fn := t.fn
+	if fn.Type.TypeParams != nil {
+		return fn.Name.Pos(), "type parameters"
+	}
+	for _, field := range fn.Type.Params.List {
+		if len(field.Names) == 0 {
+			return field.Pos(), "parameter without a name"
+		}
+	}
+
+	var (
+		pos    token.Pos
+		reason string
+	)
+	fail := func(p token.Pos, format string, args ...interface{}) {
+		if reason == "" {
+			pos, reason = p, fmt.Sprintf(format, args...)
+		}
+	}
+	var walk func(n ast.Node, closure bool)
+	walk = func(n ast.Node, closure bool) {
+		ast.Inspect(n, func(n ast.Node) bool {
+			switch n := n.(type) {
+			case *ast.FuncLit:
+				if !closure {
+					walk(n.Body, true)
+					return false
+				}
+			case *ast.DeferStmt:
+				if !closure {
+					fail(n.Pos(), "defer statement")
+				}
+			case *ast.Ident:
+				switch {
+				case closure && t.params[n.Obj]:
+					fail(n.Pos(), "closure captures parameter %s", n.Name)
+				case closure && t.results[n.Obj]:
+					fail(n.Pos(), "closure captures named result %s", n.Name)
+				case !closure && n.Obj != nil && !t.params[n.Obj] && t.isParamName(n.Name):
+					fail(n.Pos(), "parameter %s is redeclared", n.Name)
+				}
+			case *ast.UnaryExpr:
+				if id := rootIdent(n.X); n.Op == token.AND && id != nil {
+					if t.params[id.Obj] {
+						fail(n.Pos(), "address of parameter %s is taken", id.Name)
+					} else if t.results[id.Obj] {
+						fail(n.Pos(), "address of named result %s is taken", id.Name)
+					}
+				}
+			case *ast.AssignStmt:
+				for _, lhs := range n.Lhs {
+					t.checkResult(lhs, fail)
+				}
+			case *ast.IncDecStmt:
+				t.checkResult(n.X, fail)
+			case *ast.RangeStmt:
+				if n.Tok == token.ASSIGN {
+					t.checkResult(n.Key, fail)
+					t.checkResult(n.Value, fail)
+				}
+			}
+			return true
+		})
+	}
+	walk(fn.Body, false)
+	if reason != "" {
+		return pos, reason
+	}
+
+	sites := make(map[*ast.CallExpr]bool)
+	for _, site := range t.sites {
+		sites[site.call] = true
+	}
+	nparams := fn.Type.Params.NumFields()
+	for _, call := range t.calls {
+		if !sites[call] {
+			return call.Pos(), "recursive call is not in tail position"
+		}
+		if t.isVariadic() && !call.Ellipsis.IsValid() && len(call.Args) < nparams-1 {
+			return call.Pos(), "multi-value argument of variadic call"
+		}
+	}
+	return token.NoPos, ""
+}
+
+// checkResult reports the named result the expression assigns to
+func (t *tailRec) checkResult(e ast.Expr, fail func(token.Pos, string, ...interface{})) {
+	if id := rootIdent(e); id != nil && t.results[id.Obj] {
+		fail(id.Pos(), "named result %s is modified", id.Name)
+	}
+}
+
+func (t *tailRec) isParamName(name string) bool {
+	for obj := range t.params {
+		if obj.Name == name && name != "_" {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *tailRec) isVariadic() bool {
+	list := t.fn.Type.Params.List
+	if len(list) == 0 {
+		return false
+	}
+	_, ok := list[len(list)-1].Type.(*ast.Ellipsis)
+	return ok
+}
+
+func unparen(e ast.Expr) ast.Expr {
+	for {
+		p, ok := e.(*ast.ParenExpr)
+		if !ok {
+			return e
+		}
+		e = p.X
+	}
+}
+
+// rootIdent returns the variable the expression refers to, or a part of it
+func rootIdent(e ast.Expr) *ast.Ident {
+	for {
+		switch x := e.(type) {
+		case *ast.Ident:
+			return x
+		case *ast.ParenExpr:
+			e = x.X
+		case *ast.SelectorExpr:
+			e = x.X
+		case *ast.IndexExpr:
+			e = x.X
+		default:
+			return nil
+		}
+	}
+}
+
+// rewrite wraps the function body into a loop and replaces recursive calls with assignments to parameters
+func (t *tailRec) rewrite() {
+	body := &t.fn.Body.List
+	var label *ast.Ident
+	for _, site := range t.sites {
+		if site.inLoop {
+			label = ast.NewIdent(t.freshLabel())
+			break
+		}
+	}
+
+	loops := false
+	// sites of the same list are found in order, so replacing them backwards keeps indexes valid
+	for i := len(t.sites) - 1; i >= 0; i-- {
+		site := t.sites[i]
+		var repl []ast.Stmt
+		if assign := t.assign(site.call); assign != nil {
+			repl = append(repl, assign)
+		}
+		if site.list == body && site.i+site.n == len(*body) {
+			loops = true
+		} else {
+			// continue takes the place of the last statement of the site, like a bare return following the call
+			last := (*site.list)[site.i+site.n-1]
+			repl = append(repl, &ast.BranchStmt{TokPos: last.Pos(), Tok: token.CONTINUE, Label: label})
+		}
+		list := *site.list
+		res := append([]ast.Stmt{}, list[:site.i]...)
+		res = append(res, repl...)
+		*site.list = append(res, list[site.i+site.n:]...)
+	}
+
+	stmts := *body
+	if !loops && t.fn.Type.Results.NumFields() == 0 {
+		if _, ok := stmts[len(stmts)-1].(*ast.ReturnStmt); !ok {
+			stmts = append(stmts, &ast.ReturnStmt{})
+		}
+	}
+	start := t.fn.Body.Lbrace + 1
+	var loop ast.Stmt = &ast.ForStmt{For: start, Body: &ast.BlockStmt{Lbrace: start, List: stmts, Rbrace: t.fn.Body.Rbrace}}
+	if label != nil {
+		label.NamePos = start
+		loop = &ast.LabeledStmt{Label: label, Colon: start, Stmt: loop}
+	}
+	*body = []ast.Stmt{loop}
+}
+
+// assign returns the assignment of arguments of the recursive call to parameters, or nil if there is nothing to
+// assign. Parameters passed as is are skipped.
+func (t *tailRec) assign(call *ast.CallExpr) ast.Stmt {
+	var names []*ast.Ident
+	for _, field := range t.fn.Type.Params.List {
+		names = append(names, field.Names...)
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	args := call.Args
+	if t.isVariadic() && !call.Ellipsis.IsValid() {
+		fixed := len(names) - 1
+		args = append([]ast.Expr{}, call.Args[:fixed]...)
+		if rest := call.Args[fixed:]; len(rest) == 0 {
+			args = append(args, ast.NewIdent("nil"))
+		} else {
+			elt := t.fn.Type.Params.List[len(t.fn.Type.Params.List)-1].Type.(*ast.Ellipsis).Elt
+			args = append(args, &ast.CompositeLit{Type: &ast.ArrayType{Elt: elt}, Elts: rest})
+		}
+	}
+	if len(args) != len(names) {
+		// a call with multi-value argument
+		lhs := make([]ast.Expr, 0, len(names))
+		for _, name := range names {
+			lhs = append(lhs, &ast.Ident{NamePos: call.Pos(), Name: name.Name})
+		}
+		return &ast.AssignStmt{Lhs: lhs, TokPos: call.Pos(), Tok: token.ASSIGN, Rhs: args}
+	}
+
+	var lhs, rhs []ast.Expr
+	for i, name := range names {
+		if id, ok := unparen(args[i]).(*ast.Ident); ok && id.Obj != nil && id.Obj == name.Obj {
+			continue
+		}
+		lhs = append(lhs, &ast.Ident{NamePos: call.Pos(), Name: name.Name})
+		rhs = append(rhs, args[i])
+	}
+	if len(lhs) == 0 {
+		return nil
+	}
+	return &ast.AssignStmt{Lhs: lhs, TokPos: call.Pos(), Tok: token.ASSIGN, Rhs: rhs}
+}
+
+// freshLabel returns a label name that is not used in the function
+func (t *tailRec) freshLabel() string {
+	used := make(map[string]bool)
+	ast.Inspect(t.fn.Body, func(n ast.Node) bool {
+		if l, ok := n.(*ast.LabeledStmt); ok {
+			used[l.Label.Name] = true
+		}
+		return true
+	})
+	name := "loop"
+	for i := 1; used[name]; i++ {
+		name = "loop" + strconv.Itoa(i)
+	}
+	return name
+}
@@ -0,0 +1,417 @@
+package gofactor
+
+import (
+	"errors"
+	"fmt"
+	"go/token"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/bblfsh/sdk/v3/uast"
+	"github.com/bblfsh/sdk/v3/uast/nodes"
+	"github.com/bblfsh/sdk/v3/uast/transformer"
+
+	"github.com/lwsanty/gofactor/transform/vartransform"
+)
+
+// templatePrefix starts names of template functions after expandOps, it is a letter, so the result is a valid
+// identifier
+const templatePrefix = "ǂ"
+
+// templateFunc is a function of after snippets, called as $name(...), that computes an identifier or a string literal from values of
+// metavariables. Arguments are names of identifiers, selected names of selector expressions and contents of string
+// literals, the result has the kind of the first argument that is not a string literal of the snippet.
+type templateFunc struct {
+	// params is the number of parameters, the minimal one for variadic functions
+	params   int
+	variadic bool
+	// pattern is the index of the parameter holding a regular expression, zero if there is none
+	pattern int
+	// literal is set if the function always returns a string literal
+	literal bool
+	fn      func(args []string) (string, error)
+}
+
+var templateFuncs = map[string]templateFunc{
+	"trimPrefix": {params: 2, fn: func(args []string) (string, error) {
+		return strings.TrimPrefix(args[0], args[1]), nil
+	}},
+	"trimSuffix": {params: 2, fn: func(args []string) (string, error) {
+		return strings.TrimSuffix(args[0], args[1]), nil
+	}},
+	"toUpper": {params: 1, fn: func(args []string) (string, error) {
+		return strings.ToUpper(args[0]), nil
+	}},
+	"toLower": {params: 1, fn: func(args []string) (string, error) {
+		return strings.ToLower(args[0]), nil
+	}},
+	"toCamel": {params: 1, fn: func(args []string) (string, error) {
+		return toCamel(args[0], true), nil
+	}},
+	"toLowerCamel": {params: 1, fn: func(args []string) (string, error) {
+		return toCamel(args[0], false), nil
+	}},
+	"toSnake": {params: 1, fn: func(args []string) (string, error) {
+		words := splitWords(args[0])
+		for i, w := range words {
+			words[i] = strings.ToLower(w)
+		}
+		return strings.Join(words, "_"), nil
+	}},
+	"concat": {params: 2, variadic: true, fn: func(args []string) (string, error) {
+		return strings.Join(args, ""), nil
+	}},
+	"quote": {params: 1, literal: true, fn: func(args []string) (string, error) {
+		return args[0], nil
+	}},
+	"replace": {params: 3, pattern: 1, fn: func(args []string) (string, error) {
+		re, err := compileRegexp(args[1])
+		if err != nil {
+			return "", err
+		}
+		return re.ReplaceAllString(args[0], args[2]), nil
+	}},
+}
+
+// regexps caches regular expressions of template functions
+var regexps sync.Map
+
+func compileRegexp(s string) (*regexp.Regexp, error) {
+	if re, ok := regexps.Load(s); ok {
+		return re.(*regexp.Regexp), nil
+	}
+	re, err := regexp.Compile(s)
+	if err != nil {
+		return nil, err
+	}
+	regexps.Store(s, re)
+	return re, nil
+}
+
+// splitWords splits snake_case and CamelCase names into words, initialisms are kept as single words
+func splitWords(s string) []string {
+	var words []string
+	for _, part := range strings.Split(s, "_") {
+		runes := []rune(part)
+		start := 0
+		for i := 1; i < len(runes); i++ {
+			if !unicode.IsUpper(runes[i]) {
+				continue
+			}
+			prev := runes[i-1]
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) ||
+				unicode.IsUpper(prev) && i+1 < len(runes) && unicode.IsLower(runes[i+1]) {
+				words = append(words, string(runes[start:i]))
+				start = i
+			}
+		}
+		if start < len(runes) {
+			words = append(words, string(runes[start:]))
+		}
+	}
+	return words
+}
+
+// toCamel joins words of the name capitalizing all of them except, if exported is not set, the first one which is
+// lowercased
+func toCamel(s string, exported bool) string {
+	words := splitWords(s)
+	for i, w := range words {
+		if i == 0 && !exported {
+			words[i] = strings.ToLower(w)
+			continue
+		}
+		runes := []rune(w)
+		runes[0] = unicode.ToUpper(runes[0])
+		words[i] = string(runes)
+	}
+	return strings.Join(words, "")
+}
+
+// templateValue is the value of a template expression
+type templateValue struct {
+	str string
+	// literal is set for string literals
+	literal bool
+	// constant is set for string literals of the snippet
+	constant bool
+	// sel is set for selector expressions, str is the selected name
+	sel nodes.Object
+}
+
+// templateExpr evaluates an argument of a template function given values of metavariables used by the template
+type templateExpr func(vals []nodes.Node) (templateValue, error)
+
+// isTemplateCall checks if the node is a call of a template function
+func isTemplateCall(n nodes.Node) bool {
+	obj, ok := n.(nodes.Object)
+	if !ok || uast.TypeOf(obj) != "CallExpr" {
+		return false
+	}
+	fun, ok := obj["Fun"].(nodes.Object)
+	if !ok || uast.TypeOf(fun) != "Ident" {
+		return false
+	}
+	name, _ := fun["Name"].(nodes.String)
+	if !strings.HasPrefix(string(name), templatePrefix) {
+		return false
+	}
+	_, ok = templateFuncs[strings.TrimPrefix(string(name), templatePrefix)]
+	return ok
+}
+
+// templateName returns the name of the called template function
+func templateName(call nodes.Object) string {
+	name, _ := call["Fun"].(nodes.Object)["Name"].(nodes.String)
+	return strings.TrimPrefix(string(name), templatePrefix)
+}
+
+// templateOp returns the operation constructing the result of the template function call
+func templateOp(call nodes.Object) (transformer.MappingOp, error) {
+	var vars []string
+	expr, err := compileTemplate(call, &vars)
+	if err != nil {
+		return nil, err
+	}
+	if len(vars) == 0 {
+		return nil, fmt.Errorf("template function %s does not use metavariables", templateName(call))
+	}
+	fn := func(vals []nodes.Node) (nodes.Node, error) {
+		v, err := expr(vals)
+		if err != nil {
+			return nil, err
+		}
+		if v.sel != nil && !v.literal {
+			if !token.IsIdentifier(v.str) {
+				return nil, fmt.Errorf("template function constructs invalid identifier %q", v.str)
+			}
+			sel := v.sel.CloneObject()
+			sel["Sel"] = nodes.Object{
+				uast.KeyType: nodes.String("Ident"),
+				"Name":       nodes.String(v.str),
+			}
+			return sel, nil
+		}
+		if v.literal {
+			return nodes.Object{
+				uast.KeyType: nodes.String("BasicLit"),
+				"Kind":       nodes.String(token.STRING.String()),
+				"Value":      nodes.String(strconv.Quote(v.str)),
+			}, nil
+		}
+		if !token.IsIdentifier(v.str) {
+			return nil, fmt.Errorf("template function constructs invalid identifier %q", v.str)
+		}
+		return nodes.Object{
+			uast.KeyType: nodes.String("Ident"),
+			"Name":       nodes.String(v.str),
+		}, nil
+	}
+	return vartransform.Computed(fn, vars...), nil
+}
+
+// compileTemplate compiles an argument of a template function, metavariables used by the argument are added to vars
+func compileTemplate(n nodes.Node, vars *[]string) (templateExpr, error) {
+	obj, _ := n.(nodes.Object)
+	switch uast.TypeOf(obj) {
+	case "CallExpr":
+		if isTemplateCall(obj) {
+			return compileCall(obj, vars)
+		}
+	case "Ident":
+		name := string(obj["Name"].(nodes.String))
+		if _, op, ok := splitOp(name); ok {
+			return nil, fmt.Errorf("custom operation %s can't be used in template functions", op)
+		} else if isFreshVar(name) {
+			return nil, fmt.Errorf("fresh identifier %s can't be used in template functions", name)
+		} else if !isMetaVar(name) {
+			break
+		}
+		i := 0
+		for i < len(*vars) && (*vars)[i] != name {
+			i++
+		}
+		if i == len(*vars) {
+			*vars = append(*vars, name)
+		}
+		return func(vals []nodes.Node) (templateValue, error) {
+			return nodeValue(vals[i])
+		}, nil
+	case "BasicLit":
+		v, err := nodeValue(obj)
+		if err != nil {
+			break
+		}
+		v.constant = true
+		return func(vals []nodes.Node) (templateValue, error) {
+			return v, nil
+		}, nil
+	}
+	return nil, errors.New("arguments of template functions must be metavariables, string literals or template function calls")
+}
+
+func compileCall(call nodes.Object, vars *[]string) (templateExpr, error) {
+	name := templateName(call)
+	f := templateFuncs[name]
+	args, _ := call["Args"].(nodes.Array)
+	if len(args) < f.params || !f.variadic && len(args) != f.params {
+		return nil, fmt.Errorf("template function %s takes %d arguments, got %d", name, f.params, len(args))
+	}
+	exprs := make([]templateExpr, 0, len(args))
+	for i, arg := range args {
+		if i == f.pattern && f.pattern != 0 {
+			if v, err := nodeValue(arg); err == nil && v.literal {
+				if _, err := compileRegexp(v.str); err != nil {
+					return nil, fmt.Errorf("template function %s: %v", name, err)
+				}
+			}
+		}
+		expr, err := compileTemplate(arg, vars)
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, expr)
+	}
+	return func(vals []nodes.Node) (templateValue, error) {
+		res := templateValue{literal: true, constant: true}
+		strs := make([]string, 0, len(exprs))
+		for _, expr := range exprs {
+			v, err := expr(vals)
+			if err != nil {
+				return res, err
+			}
+			if res.constant && !v.constant {
+				res.literal, res.sel, res.constant = v.literal, v.sel, false
+			}
+			strs = append(strs, v.str)
+		}
+		if f.literal {
+			res.literal = true
+		}
+		str, err := f.fn(strs)
+		if err != nil {
+			return res, fmt.Errorf("template function %s: %v", name, err)
+		}
+		res.str = str
+		return res, nil
+	}, nil
+}
+
+// nodeValue returns the name of the identifier, the selected name of the selector expression or the contents of the
+// string literal
+func nodeValue(n nodes.Node) (templateValue, error) {
+	obj, _ := n.(nodes.Object)
+	switch uast.TypeOf(obj) {
+	case "Ident":
+		if name, ok := obj["Name"].(nodes.String); ok {
+			return templateValue{str: baseName(string(name))}, nil
+		}
+	case "SelectorExpr":
+		if v, err := nodeValue(obj["Sel"]); err == nil {
+			v.sel = obj
+			return v, nil
+		}
+	case "BasicLit":
+		if obj["Kind"] == nodes.String(token.STRING.String()) {
+			if s, err := strconv.Unquote(string(obj["Value"].(nodes.String))); err == nil {
+				return templateValue{str: s, literal: true}, nil
+			}
+		}
+	}
+	return templateValue{}, fmt.Errorf("template functions can only be applied to identifiers, selectors and string literals, got %s", uast.TypeOf(obj))
+}
+
+// templateArg matches nodes template functions can be applied to, so bindings of other nodes make the match fail
+type templateArg struct{}
+
+func (templateArg) Kinds() nodes.Kind {
+	return nodes.KindObject
+}
+
+func (templateArg) Check(st *transformer.State, n nodes.Node) (bool, error) {
+	_, err := nodeValue(n)
+	return err == nil, nil
+}
+
+// templateVars returns metavariables used as arguments of template functions of the snippet
+func templateVars(n nodes.Node) map[string]struct{} {
+	vars := make(map[string]struct{})
+	walkTemplates(n, func(call nodes.Object) {
+		for name := range metaVars(call) {
+			vars[name] = struct{}{}
+		}
+	})
+	return vars
+}
+
+// walkTemplates calls fn for each outermost template function call of the snippet
+func walkTemplates(n nodes.Node, fn func(call nodes.Object)) {
+	switch o := n.(type) {
+	case nodes.Object:
+		if isTemplateCall(o) {
+			fn(o)
+			return
+		}
+		for _, v := range o {
+			walkTemplates(v, fn)
+		}
+	case nodes.Array:
+		for _, v := range o {
+			walkTemplates(v, fn)
+		}
+	}
+}
+
+// strayTemplate returns the name of a template function that is referenced not as a called function, like in
+// X1.$trimPrefix(X2, "Get")()
+func strayTemplate(n nodes.Node) (string, bool) {
+	switch o := n.(type) {
+	case nodes.Object:
+		if isTemplateCall(o) {
+			return "", false
+		}
+		if uast.TypeOf(o) == "Ident" {
+			name, _ := o["Name"].(nodes.String)
+			if strings.HasPrefix(string(name), templatePrefix) {
+				return strings.TrimPrefix(string(name), templatePrefix), true
+			}
+			return "", false
+		}
+		for _, v := range o {
+			if name, ok := strayTemplate(v); ok {
+				return name, true
+			}
+		}
+	case nodes.Array:
+		for _, v := range o {
+			if name, ok := strayTemplate(v); ok {
+				return name, true
+			}
+		}
+	}
+	return "", false
+}
+
+// checkTemplates checks that template functions are used only in after snippet and are called correctly
+func checkTemplates(in, out nodes.Node) error {
+	for _, n := range []nodes.Node{in, out} {
+		if name, ok := strayTemplate(n); ok {
+			return fmt.Errorf("template function %s can only be called directly, as $%s(...)", name, name)
+		}
+	}
+	var err error
+	walkTemplates(in, func(call nodes.Object) {
+		if err == nil {
+			err = fmt.Errorf("template function %s can only be used in after snippet", templateName(call))
+		}
+	})
+	walkTemplates(out, func(call nodes.Object) {
+		if err == nil {
+			_, err = templateOp(call)
+		}
+	})
+	return err
+}
@@ -0,0 +1,27 @@
+package main
+
+import "fmt"
+
+func factorial(n, acc int) int {
+	for {
+		if n <= 1 {
+			return acc
+		}
+		n, acc = n-1, n*acc
+	}
+}
+
+func gcd(a, b int) int {
+	for {
+		if b == 0 {
+			return a
+		} else {
+			a, b = b, a%b
+			continue
+		}
+	}
+}
+
+func main() {
+	fmt.Println(factorial(5, 1), gcd(12, 18))
+}
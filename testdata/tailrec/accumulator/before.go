@@ -0,0 +1,22 @@
+package main
+
+import "fmt"
+
+func factorial(n, acc int) int {
+	if n <= 1 {
+		return acc
+	}
+	return factorial(n-1, n*acc)
+}
+
+func gcd(a, b int) int {
+	if b == 0 {
+		return a
+	} else {
+		return gcd(b, a%b)
+	}
+}
+
+func main() {
+	fmt.Println(factorial(5, 1), gcd(12, 18))
+}
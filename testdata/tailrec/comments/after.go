@@ -0,0 +1,24 @@
+package main
+
+import "fmt"
+
+// gcd computes the greatest common divisor
+func gcd(a, b int) int {
+	for {
+		// base case
+		if b == 0 {
+			return a // done
+		}
+		/* swap and reduce */
+		a, b = b, a%b
+	}
+}
+
+// other is unrelated
+func other() {}
+
+func main() {
+	// print the result
+	fmt.Println(gcd(12, 18))
+	other()
+}
@@ -0,0 +1,22 @@
+package main
+
+import "fmt"
+
+// gcd computes the greatest common divisor
+func gcd(a, b int) int {
+	// base case
+	if b == 0 {
+		return a // done
+	}
+	/* swap and reduce */
+	return gcd(b, a%b)
+}
+
+// other is unrelated
+func other() {}
+
+func main() {
+	// print the result
+	fmt.Println(gcd(12, 18))
+	other()
+}
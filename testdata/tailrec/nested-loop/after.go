@@ -0,0 +1,24 @@
+package main
+
+import "fmt"
+
+func find(xs []int, v, from int) int {
+loop:
+	for {
+		for i := from; i < len(xs); i++ {
+			if xs[i] < 0 {
+				from = i + 1
+				continue loop
+
+			}
+			if xs[i] == v {
+				return i
+			}
+		}
+		return -1
+	}
+}
+
+func main() {
+	fmt.Println(find([]int{1, -1, 2}, 2, 0))
+}
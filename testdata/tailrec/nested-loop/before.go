@@ -0,0 +1,19 @@
+package main
+
+import "fmt"
+
+func find(xs []int, v, from int) int {
+	for i := from; i < len(xs); i++ {
+		if xs[i] < 0 {
+			return find(xs, v, i+1)
+		}
+		if xs[i] == v {
+			return i
+		}
+	}
+	return -1
+}
+
+func main() {
+	fmt.Println(find([]int{1, -1, 2}, 2, 0))
+}
@@ -0,0 +1,30 @@
+package main
+
+import "fmt"
+
+func countdown(n int) {
+	for {
+		if n == 0 {
+			fmt.Println("done")
+			return
+		}
+		fmt.Println(n)
+		n = n - 1
+	}
+}
+
+func skip(lines []string) {
+	for {
+		if len(lines) > 0 && lines[0] == "" {
+			lines = lines[1:]
+			continue
+		}
+		fmt.Println(lines)
+		return
+	}
+}
+
+func main() {
+	countdown(3)
+	skip([]string{"", "a"})
+}
@@ -0,0 +1,25 @@
+package main
+
+import "fmt"
+
+func countdown(n int) {
+	if n == 0 {
+		fmt.Println("done")
+		return
+	}
+	fmt.Println(n)
+	countdown(n - 1)
+}
+
+func skip(lines []string) {
+	if len(lines) > 0 && lines[0] == "" {
+		skip(lines[1:])
+		return
+	}
+	fmt.Println(lines)
+}
+
+func main() {
+	countdown(3)
+	skip([]string{"", "a"})
+}
@@ -0,0 +1,30 @@
+package main
+
+import "fmt"
+
+func sum(acc int, xs ...int) int {
+	for {
+		if len(xs) == 0 {
+			return acc
+		}
+		acc, xs = acc+xs[0], xs[1:]
+	}
+}
+
+func join(sep string, parts ...string) string {
+	for {
+		if len(parts) > 2 {
+			parts = []string{parts[0] + sep + parts[1], parts[2]}
+			continue
+		}
+		if len(parts) == 2 {
+			parts = []string{parts[0] + sep + parts[1]}
+			continue
+		}
+		return parts[0]
+	}
+}
+
+func main() {
+	fmt.Println(sum(0, 1, 2, 3), join(",", "a", "b", "c"))
+}
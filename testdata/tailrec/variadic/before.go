@@ -0,0 +1,24 @@
+package main
+
+import "fmt"
+
+func sum(acc int, xs ...int) int {
+	if len(xs) == 0 {
+		return acc
+	}
+	return sum(acc+xs[0], xs[1:]...)
+}
+
+func join(sep string, parts ...string) string {
+	if len(parts) > 2 {
+		return join(sep, parts[0]+sep+parts[1], parts[2])
+	}
+	if len(parts) == 2 {
+		return join(sep, parts[0]+sep+parts[1])
+	}
+	return parts[0]
+}
+
+func main() {
+	fmt.Println(sum(0, 1, 2, 3), join(",", "a", "b", "c"))
+}
@@ -0,0 +1,166 @@
+package gofactor
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/scanner"
+	"go/token"
+	"strings"
+)
+
+// SyntaxError is returned by Rewrite and Apply in tolerant mode if the code has syntax errors. The rewritten code is
+// returned together with it: rules are applied to well-formed declarations, declarations with errors are left as is.
+type SyntaxError struct {
+	Errors scanner.ErrorList
+}
+
+func (e *SyntaxError) Error() string {
+	return e.Errors.Error()
+}
+
+// brokenPlaceholder replaces a declaration with syntax errors while the rest of the file is rewritten
+const brokenPlaceholder = "var _ = gofactorBrokenDecl%d"
+
+// declHeader is a prefix used to parse a single declaration of the file
+const declHeader = "package p\n"
+
+// rewriteTolerant is like rewriteCode, but if the code has syntax errors, it applies the rules only to well-formed
+// declarations and returns SyntaxError with the result.
+// Declarations with syntax errors are found in the partial AST returned by the parser. The parser can't recover from
+// some errors, like unbalanced braces, and the broken declaration swallows the following ones, so it is cut at the
+// next declaration keyword at the beginning of a line, and the rest of the file is parsed again.
+func rewriteTolerant(code string, conf config, d *dispatcher) (string, bool, error) {
+	clean := code
+	var (
+		broken []string
+		errs   scanner.ErrorList
+		// used are qualifiers used by broken declarations, their imports are never removed
+		used = make(map[string]struct{})
+		// shift is the difference between offsets in the original code and in the clean one
+		shift int
+	)
+	for {
+		fs := token.NewFileSet()
+		f, err := parser.ParseFile(fs, "input.go", clean, parser.AllErrors|parser.ParseComments)
+		if err == nil {
+			break
+		}
+		list, ok := err.(scanner.ErrorList)
+		if !ok {
+			return "", false, err
+		}
+		decl := brokenDecl(f, list)
+		if decl == nil {
+			// the package clause or something between declarations is broken
+			return "", false, err
+		}
+		start := fs.Position(decl.Pos()).Offset
+		if fd, ok := decl.(*ast.FuncDecl); ok && fd.Doc != nil {
+			start = fs.Position(fd.Doc.Pos()).Offset
+		} else if gd, ok := decl.(*ast.GenDecl); ok && gd.Doc != nil {
+			start = fs.Position(gd.Doc.Pos()).Offset
+		}
+		end := nextDecl(clean, fs.Position(decl.Pos()).Offset)
+		src := strings.TrimRight(clean[start:end], " \t\r\n")
+
+		orig := start + shift
+		line := strings.Count(code[:orig], "\n") + 1
+		df, cerr := parser.ParseFile(token.NewFileSet(), "input.go", declHeader+src, parser.AllErrors)
+		if list, ok := cerr.(scanner.ErrorList); ok {
+			for _, e := range list {
+				e.Pos.Line += line - 2
+				e.Pos.Offset += orig - len(declHeader)
+				errs = append(errs, e)
+			}
+		}
+		if df != nil {
+			for name := range qualifiers(df) {
+				used[name] = struct{}{}
+			}
+		}
+
+		placeholder := fmt.Sprintf(brokenPlaceholder, len(broken))
+		broken = append(broken, src)
+		clean = clean[:start] + placeholder + clean[start+len(src):]
+		shift += len(src) - len(placeholder)
+	}
+	if len(broken) == 0 {
+		return rewriteCode(code, conf, d, nil)
+	}
+
+	out, changed, err := rewriteCode(clean, conf, d, used)
+	if err != nil {
+		return "", false, fmt.Errorf("%w; the code has syntax errors: %v", err, errs)
+	} else if !changed {
+		return code, false, &SyntaxError{Errors: errs}
+	}
+	for i, src := range broken {
+		out = strings.Replace(out, fmt.Sprintf(brokenPlaceholder, i), src, 1)
+	}
+	return out, true, &SyntaxError{Errors: errs}
+}
+
+// brokenDecl returns the first declaration of the partial AST that contains Bad* nodes, or the first error if
+// the parser recovered from it without them
+func brokenDecl(f *ast.File, errs scanner.ErrorList) ast.Decl {
+	if f == nil || f.Name == nil {
+		return nil
+	}
+	for _, decl := range f.Decls {
+		bad := false
+		ast.Inspect(decl, func(n ast.Node) bool {
+			switch n.(type) {
+			case *ast.BadDecl, *ast.BadStmt, *ast.BadExpr:
+				bad = true
+			}
+			return !bad
+		})
+		if bad {
+			return decl
+		}
+	}
+	// positions of the file set start at base 1, and offsets of the errors at 0
+	off := errs[0].Pos.Offset + 1
+	for _, decl := range f.Decls {
+		if int(decl.Pos()) <= off && (off < int(decl.End()) || !decl.End().IsValid()) {
+			return decl
+		}
+	}
+	return nil
+}
+
+// nextDecl returns the offset of the next top-level declaration after the one starting at the offset, or the end
+// of the code. Declarations start with a keyword at the beginning of a line, and their doc comments belong to them.
+func nextDecl(code string, offset int) int {
+	fs := token.NewFileSet()
+	file := fs.AddFile("", -1, len(code)-offset)
+	var s scanner.Scanner
+	// errors are reported by the parser
+	s.Init(file, []byte(code[offset:]), nil, scanner.ScanComments)
+	// doc is the offset of the comment group that precedes the current token, or -1
+	doc := -1
+	s.Scan()
+	for {
+		pos, tok, _ := s.Scan()
+		off := file.Offset(pos)
+		lineStart := off == 0 || code[offset+off-1] == '\n'
+		switch {
+		case tok == token.EOF:
+			return len(code)
+		case tok == token.SEMICOLON:
+			continue
+		case tok == token.COMMENT && lineStart:
+			if doc < 0 {
+				doc = off
+			}
+			continue
+		case lineStart && (tok == token.FUNC || tok == token.TYPE || tok == token.VAR || tok == token.CONST || tok == token.IMPORT):
+			if doc >= 0 {
+				return offset + doc
+			}
+			return offset + off
+		}
+		doc = -1
+	}
+}
@@ -7,8 +7,12 @@ import (
 	"github.com/bblfsh/sdk/v3/uast/transformer"
 )
 
+// MatroshkaArray matches a window of array elements against Op.
+// Matches are leftmost and never overlap: the search continues right after the last matched window.
 type MatroshkaArray struct {
 	Op transformer.ArrayOp
+	// Limit is the maximal number of matches in a single array, zero means no limit
+	Limit int
 }
 
 // Kinds defines nodes type/object/value to match to
@@ -21,61 +25,6 @@ func (m *MatroshkaArray) Check(st *transformer.State, n nodes.Node) (bool, error
 	return m.checkMultipleMatches(st, n)
 }
 
-func (m *MatroshkaArray) checkSingleMatch(st *transformer.State, n nodes.Node) (bool, error) {
-	arr, ok := n.(nodes.Array)
-	if !ok {
-		return false, nil
-	}
-
-	windowArr, err := m.Op.Arr(st)
-	if err != nil {
-		return false, err
-	}
-	// refactor window length
-	windowLen := len(windowArr)
-	if windowLen == 0 {
-		return false, fmt.Errorf("this should not happen")
-	}
-
-	// if windows length is higher then array observed => did not match
-	lenArr := len(arr)
-	if windowLen > len(arr) {
-		return false, nil
-	}
-
-	// iterate over arr and check each window for equality with windowArr
-	// if equality is detected then we need to save left and right sides to the state so reconstruct could renew it
-loop:
-	for i := 0; i <= lenArr-windowLen; i++ {
-		forkedSt := st.Clone()
-
-		// currently works for one match
-		for iter, n := range arr[i : i+windowLen] {
-			res, err := windowArr[iter].Check(forkedSt, n)
-			if err != nil {
-				return false, err
-			}
-			if !res {
-				continue loop
-			}
-		}
-		// if this code reached then we've got a match, so merge states and return true
-		st.ApplyFrom(forkedSt)
-
-		// set left and right parts to the state
-		if err := st.SetVar("left", arr[:i:i]); err != nil {
-			return false, err
-		}
-		if err := st.SetVar("right", arr[i+windowLen:]); err != nil {
-			return false, err
-		}
-
-		return true, nil
-	}
-
-	return false, nil
-}
-
 func (m *MatroshkaArray) checkMultipleMatches(st *transformer.State, n nodes.Node) (bool, error) {
 	arr, ok := n.(nodes.Array)
 	if !ok {
@@ -111,7 +60,6 @@ loop:
 	for i := 0; i <= lenArr-windowLen; i++ {
 		forkedSt := st.Clone()
 
-		// currently works for one match
 		for iter, n := range arr[i : i+windowLen] {
 			res, err := windowArr[iter].Check(forkedSt, n)
 			if err != nil {
@@ -126,6 +74,11 @@ loop:
 		statesResult = append(statesResult, forkedSt)
 		leftNodes = append(leftNodes, arr[lastMatch:i:i])
 		lastMatch = i + windowLen
+		if m.Limit > 0 && len(statesResult) >= m.Limit {
+			break
+		}
+		// continue right after the matched window, so matches do not overlap
+		i = lastMatch - 1
 	}
 	leftNodes = append(leftNodes, arr[lastMatch:])
 
@@ -146,37 +99,6 @@ func (m *MatroshkaArray) Construct(st *transformer.State, n nodes.Node) (nodes.N
 	return m.constructMultipleMatch(st, n)
 }
 
-func (m *MatroshkaArray) constructSingleMatch(st *transformer.State, n nodes.Node) (nodes.Node, error) {
-	// signature of this func is weird: n nodes.Node should be actually empty because it's used for construction
-	// for construction we need only states information
-
-	if n != nil {
-		return nil, fmt.Errorf("received node should be nil")
-	}
-
-	var result nodes.Array
-	// we can construct left and right parts implicitly
-	lArr, err := getArr(st, "left")
-	if err != nil {
-		return nil, err
-	}
-	result = append(result, lArr...)
-
-	// to construct matched part we call Construct in embedded operation
-	centerNode, err := m.Op.Construct(st, nil)
-	if err != nil {
-		return nil, err
-	}
-	result = append(result, centerNode.(nodes.Array)...)
-
-	rArr, err := getArr(st, "right")
-	if err != nil {
-		return nil, err
-	}
-
-	return append(result, rArr...), nil
-}
-
 func (m *MatroshkaArray) constructMultipleMatch(st *transformer.State, n nodes.Node) (nodes.Node, error) {
 	// signature of this func is weird: sideNode nodes.Node should be actually empty because it's used for construction
 	// for construction we need only states information
@@ -9,10 +9,22 @@ func Var(name string) transformer.MappingOp {
 	return opVar{name: name, kinds: nodes.KindsAny}
 }
 
+// Func computes a node from values of variables
+type Func func(vals []nodes.Node) (nodes.Node, error)
+
+// Computed is like Var, but constructs the result of fn applied to values of variables with given names. It can only
+// be used for construction: it never matches any node.
+func Computed(fn Func, names ...string) transformer.MappingOp {
+	return opVar{name: names[0], args: names[1:], kinds: nodes.KindsAny, fn: fn}
+}
+
 // original SDK's opVar does strict assertion to variable name, we need a softer check
 type opVar struct {
 	name  string
 	kinds nodes.Kind
+	// args are the rest of variables of a computed node
+	args []string
+	fn   Func
 }
 
 func (op opVar) Mapping() (src, dst transformer.Op) {
@@ -24,6 +36,9 @@ func (op opVar) Kinds() nodes.Kind {
 }
 
 func (op opVar) Check(st *transformer.State, n nodes.Node) (bool, error) {
+	if op.fn != nil {
+		return false, nil
+	}
 	if err := st.SetVar(op.name, n); err != nil {
 		if transformer.ErrVariableRedeclared.Is(err) {
 			return false, nil
@@ -41,6 +56,17 @@ func (op opVar) Construct(st *transformer.State, n nodes.Node) (nodes.Node, erro
 	if err != nil {
 		return nil, err
 	}
+	if op.fn != nil {
+		vals := []nodes.Node{val}
+		for _, name := range op.args {
+			val, err := st.MustGetVar(name)
+			if err != nil {
+				return nil, err
+			}
+			vals = append(vals, val)
+		}
+		return op.fn(vals)
+	}
 	// TODO: should we clone it?
 	return val, nil
 }
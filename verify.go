@@ -0,0 +1,113 @@
+package gofactor
+
+import (
+	"go/ast"
+	"go/build"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"path/filepath"
+)
+
+// TypeErrors type-checks the package located in dir and returns type errors grouped by absolute file path.
+// Contents of the files in overlay (keyed by file path) are used instead of the files on disk.
+// Imported packages are type-checked from local sources, so no network access is needed.
+func TypeErrors(dir string, overlay map[string][]byte) (map[string][]types.Error, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	src := make(map[string][]byte, len(overlay))
+	for path, data := range overlay {
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return nil, err
+		}
+		src[abs] = data
+	}
+
+	bp, err := build.ImportDir(dir, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	fset := token.NewFileSet()
+	var files []*ast.File
+	for _, name := range bp.GoFiles {
+		path := filepath.Join(dir, name)
+		// nil source makes parser read the file from disk
+		var data interface{}
+		if d, ok := src[path]; ok {
+			data = d
+		}
+		f, err := parser.ParseFile(fset, path, data, 0)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+
+	errs := make(map[string][]types.Error)
+	conf := types.Config{
+		Importer: importer.ForCompiler(fset, "source", nil),
+		Error: func(err error) {
+			if terr, ok := err.(types.Error); ok {
+				path := fset.Position(terr.Pos).Filename
+				errs[path] = append(errs[path], terr)
+			}
+		},
+	}
+	// errors are collected by the handler above
+	_, _ = conf.Check(bp.ImportPath, fset, files, nil)
+	return errs, nil
+}
+
+// NewTypeErrors returns errors from after that are not present in before. Lines of errors of after are mapped to
+// the code of before by origLine, which also reports whether the line was kept as is by the rewrite; nil origLine
+// keeps all lines. Errors at kept lines are compared by message and line, so an error with the same message elsewhere
+// doesn't hide a new one. Errors at rewritten lines are compared by message only, the number of errors counts.
+func NewTypeErrors(before, after []types.Error, origLine func(line int) (int, bool)) []types.Error {
+	type key struct {
+		msg  string
+		line int
+	}
+	// used marks errors of before matched by errors of after
+	used := make([]bool, len(before))
+	at := make(map[key][]int, len(before))
+	for i, e := range before {
+		k := key{msg: e.Msg, line: e.Fset.Position(e.Pos).Line}
+		at[k] = append(at[k], i)
+	}
+
+	var moved, res []types.Error
+	for _, e := range after {
+		line, kept := e.Fset.Position(e.Pos).Line, true
+		if origLine != nil {
+			line, kept = origLine(line)
+		}
+		if !kept {
+			moved = append(moved, e)
+			continue
+		}
+		k := key{msg: e.Msg, line: line}
+		if idx := at[k]; len(idx) != 0 {
+			used[idx[0]], at[k] = true, idx[1:]
+			continue
+		}
+		res = append(res, e)
+	}
+	for _, e := range moved {
+		found := false
+		for i, b := range before {
+			if !used[i] && b.Msg == e.Msg {
+				used[i], found = true, true
+				break
+			}
+		}
+		if !found {
+			res = append(res, e)
+		}
+	}
+	return res
+}
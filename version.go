@@ -0,0 +1,4 @@
+package gofactor
+
+// Version of gofactor. It is a part of cache keys, so it should be changed with every release.
+const Version = "0.2.0"